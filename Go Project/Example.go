@@ -2,10 +2,13 @@ package main
 
 import (
 	"GRL1/SOMACS"
+	"bytes"
 	"fmt"
 	"github.com/google/uuid"
+	"log/slog"
 	"math/rand"
 	"os"
+	"slices"
 	"time"
 )
 
@@ -27,15 +30,27 @@ type HelloModelAgent struct {
 
 func CreateHelloModelAgent(serv *SOMACS.Server) SOMACS.IGenericAgent {
 	hma := &HelloModelAgent{ModelAgent: SOMACS.CreateModelAgentBase(serv)}
-	hma.Cluster = byte(rand.Intn(numClusters))
+	hma.Cluster = byte(hma.GetRand().Intn(numClusters))
+	hma.SetValidationRequestData(append(make([]byte, 0, 1), hma.Cluster))
+	hma.setupHelloModelAgent()
+	return hma
+}
 
+// Resimulation works on copies, the closures below have to be bound to the copy rather than the original
+func (hma *HelloModelAgent) Clone(serv *SOMACS.Server) SOMACS.IGenericAgent {
+	clone := &HelloModelAgent{ModelAgent: hma.CloneModelAgentBase(serv), Cluster: hma.Cluster}
+	clone.setupHelloModelAgent()
+	return clone
+}
+
+func (hma *HelloModelAgent) setupHelloModelAgent() {
 	// For (1) Communication Partner Search
 	setupCommunicationPartnerSearch := func(*SOMACS.ModelAgent) {
-		shuffleTimer, _ := hma.GetEnvironmentVariable("ShuffleTimer")
-		if shuffleTimer[0] > 0 {
+		shuffleTimer, _, _ := SOMACS.GetEnvironmentVariableAs(hma, "ShuffleTimer", shuffleTimerCodec)
+		if shuffleTimer > 0 {
 			return
 		}
-		hma.Cluster = byte(rand.Intn(numClusters))
+		hma.Cluster = byte(hma.GetRand().Intn(numClusters))
 		hma.SetValidationRequestData(append(make([]byte, 0, 1), hma.Cluster))
 	}
 	hma.OnSetupCommunicationPartnerSearch.Subscribe(&setupCommunicationPartnerSearch)
@@ -47,7 +62,6 @@ func CreateHelloModelAgent(serv *SOMACS.Server) SOMACS.IGenericAgent {
 			return msg.Data[0] == hma.Cluster
 		},
 	)
-	hma.SetValidationRequestData(append(make([]byte, 0, 1), hma.Cluster))
 
 	// For (2) Main Communication Phase
 	setupMainCommunicationPhase := func(*SOMACS.ModelAgent) {
@@ -57,6 +71,11 @@ func CreateHelloModelAgent(serv *SOMACS.Server) SOMACS.IGenericAgent {
 	}
 	hma.OnSetupMainCommunicationPhase.Subscribe(&setupMainCommunicationPhase)
 	beginMainCommunicationPhase := func(*SOMACS.ModelAgent) {
+		// Possible in spatial scenarios, nobody will greet the agent either
+		if hma.ExpectedWorldMessages == 0 {
+			hma.EndMainCommunicationPhase()
+			return
+		}
 		msg := hma.CreateHelloMessage()
 		if isExampleSynchronous {
 			hma.BroadcastSynchronousMessageToRecipients(msg, hma.GetValidCommunicationPartners())
@@ -81,15 +100,11 @@ func CreateHelloModelAgent(serv *SOMACS.Server) SOMACS.IGenericAgent {
 	hma.OnHandleMessage.Subscribe(&handleMessage)
 
 	// For (3) State Update Phase
-	hma.SetStateUpdateFunc(
-		func() []byte {
-			state := make([]byte, 0, 1)
-			state = append(state, byte(hma.ReceivedWorldMessages))
-			return state
+	SOMACS.SetStateUpdateFuncTyped(hma.ModelAgent, helloStateCodec,
+		func() uint16 {
+			return uint16(hma.ReceivedWorldMessages)
 		},
 	)
-
-	return hma
 }
 
 // Main Communication Phase Protocol
@@ -135,11 +150,27 @@ func (hma *HelloModelAgent) CheckFinishedMainMessaging() {
 
 type HelloObserverAgent struct {
 	*SOMACS.ObserverAgent
+	history *SOMACS.ObservationHistory
 }
 
 func CreateHelloObserverAgent(serv *SOMACS.Server) SOMACS.IGenericAgent {
 	hoa := &HelloObserverAgent{ObserverAgent: SOMACS.CreateObserverAgentBase(serv)}
+	hoa.setupHelloObserverAgent()
+	return hoa
+}
+
+func (hoa *HelloObserverAgent) Clone(serv *SOMACS.Server) SOMACS.IGenericAgent {
+	clone := &HelloObserverAgent{ObserverAgent: hoa.CloneObserverAgentBase(serv)}
+	clone.setupHelloObserverAgent()
+	return clone
+}
 
+func (hoa *HelloObserverAgent) setupHelloObserverAgent() {
+	hoa.history = SOMACS.CreateObservationHistory(hoa.ObserverAgent, MSGTYPE_WORLD)
+	hoa.SetMetaAgentCooldown(metaAgentCooldown)
+	hoa.SetMetaAgentStabilityWindow(metaAgentStabilityWindow)
+	hoa.GetStatistics().SetWindow(helloStatisticsWindow)
+	hoa.GetStatistics().StateStatistics.SetSeriesLength(helloSeriesLength)
 	hoa.SetObservationStrategy(
 		func() (*[]uuid.UUID, *[]uuid.UUID) {
 			if len(*hoa.GetObservedModelAgents()) > 0 {
@@ -151,15 +182,85 @@ func CreateHelloObserverAgent(serv *SOMACS.Server) SOMACS.IGenericAgent {
 
 	onAfterAllStateUpdatesReceived := hoa.PredictMessagingGroupsAndCreateMetaAgents
 	hoa.ObserverAgent.OnAfterAllStateUpdatesReceived.Subscribe(&onAfterAllStateUpdatesReceived)
-
-	return hoa
 }
 
 func (hoa *HelloObserverAgent) PredictMessagingGroupsAndCreateMetaAgents(statistics *SOMACS.ObserverStatistics) {
-	// Pattern Detection/Classification
-	predictedGroups := make([][]uuid.UUID, 0, len(*hoa.GetObservedModelAgents()))
+	// Meta agents created right before the shuffle would mix clusters, newcomers are not subsumed by dissolving ones
+	shuffleTimer, _, _ := SOMACS.GetEnvironmentVariableAs(hoa.GetServer(), "ShuffleTimer", shuffleTimerCodec)
+	if skipSchedulingBeforeShuffle && shuffleTimer <= 1 {
+		return
+	}
+	predictedGroups := predictHelloMessagingGroups(statistics, *hoa.GetObservedModelAgents())
+
+	// Scheduling of Meta Agents according to predicted groups
+	minClusterSize := 5
+	for _, group := range predictedGroups {
+		if len(group) < minClusterSize {
+			continue
+		}
+		if helloSeriesLength > 0 && !SOMACS.AreStatesStationary(&statistics.StateStatistics, helloStateCodec, group, helloSeriesLength, 1) {
+			continue
+		}
+		fmt.Printf("Scheduling a meta agent consisting of (%v) agents...\n", len(group))
+		maGroup := make([]*SOMACS.ModelAgent, 0, len(group))
+		for _, ag := range group {
+			maGroup = append(maGroup, hoa.GetServer().GetModelAgentMap()[ag])
+		}
+
+		definition := createHelloMetaAgentDefinition(hoa.GetServer(), maGroup)
+		if predict := hoa.createPredictor(group); predict != nil {
+			definition.Predict = predict
+		}
+		hoa.ScheduleMetaAgentDefinition(maGroup, make([]*SOMACS.MetaAgent, 0), definition)
+	}
+}
+
+// States count received "World" messages, so the fitted predictors should find a slope of one
+func (hoa *HelloObserverAgent) createPredictor(group []uuid.UUID) func(*SOMACS.MessageStatistics, *SOMACS.MetaState) map[uuid.UUID][]byte {
+	switch helloPredictor {
+	case "last":
+		return SOMACS.CreateLastValuePredictor()
+	case "mean":
+		return SOMACS.CreateMeanPredictor(helloStateCodec)
+	case "regression":
+		return SOMACS.CreateLinearRegressionPredictor(helloStateCodec, hoa.history, group)
+	case "knn":
+		return SOMACS.CreateKNearestNeighbourPredictor(helloStateCodec, hoa.history, group, 5)
+	}
+	return nil
+}
+
+// Pattern Detection/Classification, kept separate so it can also run on a replayed trace
+
+func predictHelloMessagingGroups(statistics *SOMACS.ObserverStatistics, observedModelAgents []uuid.UUID) [][]uuid.UUID {
 	statistics.StateStatistics.ClearEmptyStates()
-	for _, agent := range *hoa.GetObservedModelAgents() {
+	switch helloClustering {
+	case "components":
+		return SOMACS.ClusterConnectedComponents(&statistics.MessageStatistics, observedModelAgents)
+	case "louvain":
+		return SOMACS.ClusterLouvain(&statistics.MessageStatistics, observedModelAgents)
+	case "labels":
+		return SOMACS.ClusterLabelPropagation(&statistics.MessageStatistics, observedModelAgents, rand.New(rand.NewSource(1)), 20)
+	case "kmeans":
+		return SOMACS.ClusterKMeans(&statistics.StateStatistics, helloStateCodec, observedModelAgents, numClusters, rand.New(rand.NewSource(1)), 20)
+	case "dbscan":
+		return SOMACS.ClusterDBSCAN(&statistics.StateStatistics, helloStateCodec, observedModelAgents, 0, 5)
+	case "scc":
+		graph := statistics.GetCommunicationGraph(helloStatisticsWindow, SOMACS.PHASE_MAIN_COMMUNICATION)
+		exampleLogger.Debug("communication graph", "agents", len(graph.GetNodes()), "reciprocity", graph.GetReciprocity(),
+			"clustering", graph.GetAverageClusteringCoefficient())
+		groups := make([][]uuid.UUID, 0)
+		for _, component := range graph.GetStronglyConnectedComponents() {
+			group := slices.DeleteFunc(component, func(id uuid.UUID) bool { return !slices.Contains(observedModelAgents, id) })
+			if len(group) > 0 {
+				groups = append(groups, group)
+			}
+		}
+		return groups
+	}
+
+	predictedGroups := make([][]uuid.UUID, 0, len(observedModelAgents))
+	for _, agent := range observedModelAgents {
 		fitsInGroup := false
 		for i, group := range predictedGroups {
 			groupNotEmpty := group != nil && len(group) > 0
@@ -172,132 +273,173 @@ func (hoa *HelloObserverAgent) PredictMessagingGroupsAndCreateMetaAgents(statist
 			}
 			predictedGroups[i] = append(group, agent)
 			fitsInGroup = true
+			break
 		}
 		if !fitsInGroup {
-			newGroup := make([]uuid.UUID, 0, len(*hoa.GetObservedModelAgents()))
+			newGroup := make([]uuid.UUID, 0, len(observedModelAgents))
 			newGroup = append(newGroup, agent)
 			predictedGroups = append(predictedGroups, newGroup)
 		}
 	}
+	return predictedGroups
+}
 
-	// Scheduling of Meta Agents according to predicted groups
-	minClusterSize := 5
-	for _, group := range predictedGroups {
-		if len(group) < minClusterSize {
+// Counts of at most one are skipped, the others may be off by the tolerance on the smoothed ratio (c+1)/(b+1). Names
+// the failing members, so meta agents can eject them.
+type helloErrorPolicy struct {
+	tolerance float32
+}
+
+func (hep helloErrorPolicy) Check(context *SOMACS.VerificationContext) (bool, string) {
+	result := hep.CheckMembers(context)
+	return result.Passed, result.Reason
+}
+
+func (hep helloErrorPolicy) CheckMembers(context *SOMACS.VerificationContext) SOMACS.VerificationResult {
+	failing := make([]uuid.UUID, 0)
+	maxError := float32(0)
+	for id, state := range context.State.GetModelStatesRecursive() {
+		currentValue := float32(decodeHelloState(state))
+		baseValue := float32(decodeHelloState(context.BaseState[id]))
+		if baseValue <= 1 {
 			continue
 		}
-		fmt.Printf("Creating a meta agent consisting of (%v) agents...\n", len(group))
-		maGroup := make([]*SOMACS.ModelAgent, 0, len(group))
-		for _, ag := range group {
-			maGroup = append(maGroup, hoa.GetServer().GetModelAgentMap()[ag])
+		errorValue := max((currentValue+1.0)/(baseValue+1.0), (baseValue+1.0)/(currentValue+1.0)) - 1.0
+		maxError = max(maxError, errorValue)
+		if errorValue > hep.tolerance {
+			failing = append(failing, id)
 		}
+	}
+	if len(failing) > 0 {
+		slices.SortFunc(failing, func(a, b uuid.UUID) int { return bytes.Compare(a[:], b[:]) })
+		return SOMACS.VerificationResult{Passed: false, Reason: fmt.Sprintf("error of (%v) exceeds (%v)", maxError, hep.tolerance), FailingMembers: failing}
+	}
+	return SOMACS.VerificationResult{Passed: true, Reason: fmt.Sprintf("error of (%v) within (%v)", maxError, hep.tolerance)}
+}
 
-		// Define partner search, predict, verify, evaluate (optional), explain (optional)
-		partnerSearch := func(messageStatistics *SOMACS.MessageStatistics, state *SOMACS.MetaState) (map[uuid.UUID]map[uuid.UUID]bool, map[uuid.UUID][]uuid.UUID) {
-			responses := make(map[uuid.UUID]map[uuid.UUID]bool)
-			internal := make(map[uuid.UUID][]uuid.UUID)
+// Define partner search, predict, verify, evaluate (optional), explain (optional)
+// Kept separate from the observer so meta agents can be rebuilt when loading a checkpoint
 
-			subsumedModelAgents := make([]uuid.UUID, 0)
-			for ag := range state.ModelStates {
-				subsumedModelAgents = append(subsumedModelAgents, ag)
+func createHelloMetaAgentDefinition(serv *SOMACS.Server, maGroup []*SOMACS.ModelAgent) SOMACS.MetaAgentDefinition {
+	// Removed agents leave the group, the first remaining member speaks for it
+	prime := func(isMember func(uuid.UUID) bool) *SOMACS.ModelAgent {
+		for _, ag := range maGroup {
+			if isMember(ag.GetID()) {
+				return ag
 			}
+		}
+		return maGroup[0]
+	}
+
+	partnerSearch := func(messageStatistics *SOMACS.MessageStatistics, state *SOMACS.MetaState) (map[uuid.UUID]map[uuid.UUID]bool, map[uuid.UUID][]uuid.UUID) {
+		responses := make(map[uuid.UUID]map[uuid.UUID]bool)
+		internal := make(map[uuid.UUID][]uuid.UUID)
 
-			for requester := range messageStatistics.GetCommunicationMap() {
-				msgs, _ := messageStatistics.GetAllMessagesFromAgent(requester)
-				valid := maGroup[0].ValidateMessage(msgs[0])
-				for _, ag := range subsumedModelAgents {
-					_, ok := responses[ag]
-					if !ok {
-						responses[ag] = make(map[uuid.UUID]bool)
+		subsumedModelAgents := make([]uuid.UUID, 0)
+		for ag := range state.ModelStates {
+			subsumedModelAgents = append(subsumedModelAgents, ag)
+		}
+
+		for requester := range messageStatistics.GetCommunicationMap() {
+			msgs, _ := messageStatistics.GetAllMessagesFromAgent(requester)
+			valid := prime(func(id uuid.UUID) bool {
+				_, ok := state.ModelStates[id]
+				return ok
+			}).ValidateMessage(msgs[0])
+			// Requests broadcast to everyone carry no recipient, in a space or topology only some agents are asked
+			recipients := subsumedModelAgents
+			if msgs[0].Recipient != uuid.Nil {
+				recipients = make([]uuid.UUID, 0, len(msgs))
+				for _, msg := range msgs {
+					if _, ok := state.ModelStates[msg.Recipient]; ok {
+						recipients = append(recipients, msg.Recipient)
 					}
-					responses[ag][requester] = valid
 				}
 			}
-
-			for _, ag := range subsumedModelAgents {
-				internal[ag] = subsumedModelAgents
+			for _, ag := range recipients {
+				_, ok := responses[ag]
+				if !ok {
+					responses[ag] = make(map[uuid.UUID]bool)
+				}
+				responses[ag][requester] = valid
 			}
+		}
 
-			return responses, internal
+		for _, ag := range subsumedModelAgents {
+			internal[ag] = subsumedModelAgents
 		}
 
-		predict := func(messageStatistics *SOMACS.MessageStatistics, state *SOMACS.MetaState) map[uuid.UUID][]byte {
-			var ag0 uuid.UUID
-			for ag := range state.ModelStates {
-				ag0 = ag
-				break
-			}
+		return responses, internal
+	}
 
+	predict := SOMACS.TypedPredict(helloStateCodec,
+		func(messageStatistics *SOMACS.MessageStatistics, states map[uuid.UUID]uint16) map[uuid.UUID]uint16 {
+			ag0 := prime(func(id uuid.UUID) bool {
+				_, ok := states[id]
+				return ok
+			}).GetID()
 			worldMessages, _ := messageStatistics.GetMessagesOfTypeToAgent(ag0, MSGTYPE_WORLD)
-			predictedState := make([]byte, 0, 1)
-			predictedState = append(predictedState, byte(len(worldMessages)))
 
-			ret := make(map[uuid.UUID][]byte)
-			for ag := range state.ModelStates {
-				ret[ag] = predictedState
+			ret := make(map[uuid.UUID]uint16)
+			for ag := range states {
+				ret[ag] = uint16(len(worldMessages))
 			}
 			return ret
-		}
-
-		errorTolerance := float32(0.25)
-		verify := func(messageStatistics *SOMACS.MessageStatistics, state *SOMACS.MetaState, baseState map[uuid.UUID][]byte) bool {
-			for id, predictedState := range state.ModelStates {
-				currentValue := float32(predictedState[0])
-				baseValue := float32(baseState[id][0])
-				if baseValue <= 1 {
-					continue
-				}
-				errorValue := max((currentValue+1.0)/(baseValue+1.0), (baseValue+1.0)/(currentValue+1.0)) - 1.0
-				if errorValue > errorTolerance {
-					fmt.Printf("Meta agent consisting of (%v) agents fails verify with error of (%v)\n", len(state.ModelStates), errorValue)
-					return false
-				}
-			}
-
-			shuffleTimer, _ := hoa.GetServer().GetEnvironmentVariable("ShuffleTimer")
-			if shuffleTimer[0] <= 1 {
-				fmt.Printf("Meta agent consisting of (%v) agents dissolves due to scheduled shuffle\n", len(state.ModelStates))
-				return false
-			}
+		},
+	)
 
-			return true
-		}
+	// The cluster dissolves ahead of a scheduled shuffle
+	errorTolerance := float32(0.25)
+	policy := SOMACS.CreateAndPolicy(
+		helloErrorPolicy{errorTolerance},
+		SOMACS.CreateEnvironmentGuardPolicy("ShuffleTimer", shuffleTimerCodec, func(shuffleTimer uint8) bool {
+			return shuffleTimer > 1
+		}),
+	)
 
-		evaluate := func(ag *SOMACS.MetaAgent) float32 {
-			subsumedAgents := *ag.GetSubsumedAgents()
-			reportedValue := ag.GetState().ModelStates[subsumedAgents[0]][0]
-			sizeSuggestValue := len(subsumedAgents) - 1
-			sizeBasedAccuracy := min(float32(reportedValue)/float32(sizeSuggestValue), float32(sizeSuggestValue)/float32(reportedValue))
+	evaluate := func(ag *SOMACS.MetaAgent) float32 {
+		subsumedAgents := *ag.GetSubsumedAgents()
+		reportedValue := decodeHelloState(ag.GetState().ModelStates[subsumedAgents[0]])
+		sizeSuggestValue := len(subsumedAgents) - 1
+		sizeBasedAccuracy := min(float32(reportedValue)/float32(sizeSuggestValue), float32(sizeSuggestValue)/float32(reportedValue))
 
-			if evaluateVerbose {
-				fmt.Printf("Meta Agent (%v) of size %v reports value (%v). This suggests accuracy (%v).\n",
-					ag.GetID(), len(subsumedAgents), reportedValue, sizeBasedAccuracy)
-			}
-			accuracyList = append(accuracyList, sizeBasedAccuracy)
-			return sizeBasedAccuracy
+		if evaluateVerbose {
+			fmt.Printf("Meta Agent (%v) of size %v reports value (%v). This suggests accuracy (%v).\n",
+				ag.GetID(), len(subsumedAgents), reportedValue, sizeBasedAccuracy)
 		}
+		accuracyList = append(accuracyList, sizeBasedAccuracy)
+		return sizeBasedAccuracy
+	}
 
-		explain := func(ag *SOMACS.MetaAgent) {
-			if !explainabilityVerbose {
-				return
-			}
-			fmt.Printf("Explanation for Meta Agent (%v):\n"+
-				"\tPredicts a cluster of (%v) agents around uuid (%v).\n"+
-				"\tAgents in the cluster received (%v) \"World\" messages at base, and (%v) last iteration.\n"+
-				"\tIf the uniform predicted value is within (%v)%s of the measured base value, it passes verification.\n",
-				ag.GetID(),
-				len(*ag.GetSubsumedAgents()), (*ag.GetSubsumedAgents())[0],
-				ag.GetCondition().GetBaseState()[(*ag.GetSubsumedAgents())[0]][0], ag.GetState().ModelStates[(*ag.GetSubsumedAgents())[0]][0],
-				int(errorTolerance*100), "%")
-			fmt.Printf("Counterfactual Explanation for Meta Agent (%v):\n"+
-				"\tMeta agent would fail verification if prime agent received more than (%v) or less than (%v) messages\n"+
-				"\tMeta agent would fail verification if the \"Time until clusters shuffle\" environment variable was 1 or lower.\n",
-				ag.GetID(),
-				int((1.0+errorTolerance)*float32(ag.GetCondition().GetBaseState()[(*ag.GetSubsumedAgents())[0]][0])),
-				int(1.0/(1.0+errorTolerance)*float32(ag.GetCondition().GetBaseState()[(*ag.GetSubsumedAgents())[0]][0])))
+	explain := func(ag *SOMACS.MetaAgent) {
+		if !explainabilityVerbose {
+			return
 		}
+		prime := (*ag.GetSubsumedAgents())[0]
+		baseValue := decodeHelloState(ag.GetCondition().GetBaseState()[prime])
+		fmt.Printf("Explanation for Meta Agent (%v):\n"+
+			"\tPredicts a cluster of (%v) agents around uuid (%v).\n"+
+			"\tAgents in the cluster received (%v) \"World\" messages at base, and (%v) last iteration.\n"+
+			"\tIf the uniform predicted value is within (%v)%s of the measured base value, it passes verification.\n",
+			ag.GetID(),
+			len(*ag.GetSubsumedAgents()), prime,
+			baseValue, decodeHelloState(ag.GetState().ModelStates[prime]),
+			int(errorTolerance*100), "%")
+		fmt.Printf("Counterfactual Explanation for Meta Agent (%v):\n"+
+			"\tMeta agent would fail verification if prime agent received more than (%v) or less than (%v) messages\n"+
+			"\tMeta agent would fail verification if the \"Time until clusters shuffle\" environment variable was 1 or lower.\n",
+			ag.GetID(),
+			int((1.0+errorTolerance)*float32(baseValue)),
+			int(1.0/(1.0+errorTolerance)*float32(baseValue)))
+	}
 
-		hoa.ScheduleMetaAgent(maGroup, make([]*SOMACS.MetaAgent, 0), partnerSearch, predict, verify, evaluate, explain)
+	return SOMACS.MetaAgentDefinition{
+		PartnerSearch: partnerSearch,
+		Predict:       predict,
+		Policy:        policy,
+		Evaluate:      evaluate,
+		Explain:       explain,
+		DissolveMode:  metaAgentDissolveMode,
 	}
 }
 
@@ -307,16 +449,50 @@ func CreateHelloServer(numAgents, iterations int, maxDuration time.Duration, age
 	serv := SOMACS.CreateServer([]int{numAgents}, []func(*SOMACS.Server) SOMACS.IGenericAgent{CreateHelloModelAgent},
 		[]int{spawnObservers}, []func(*SOMACS.Server) SOMACS.IGenericAgent{CreateHelloObserverAgent},
 		3, iterations, maxDuration, agentBandwidth)
+	serv.SetInternalMessagesSynchronous(isExampleSynchronous)
+	setupHelloServer(serv)
+	return serv
+}
 
-	serv.SetEnvironmentVariable("ShuffleTimer", []byte{timeBetweenShuffles})
-	onUpdateEnvironment := func(serv *SOMACS.Server) {
-		timer, _ := serv.GetEnvironmentVariable("ShuffleTimer")
-		if timer[0] == 0 {
-			serv.SetEnvironmentVariable("ShuffleTimer", []byte{timeBetweenShuffles})
-			return
-		}
-		serv.SetEnvironmentVariable("ShuffleTimer", []byte{timer[0] - 1})
+// Same scenario, but agent types and counts are read from a scenario file (s. ExampleScenario.yaml)
+
+func CreateHelloServerFromFile(path string) (*SOMACS.Server, error) {
+	SOMACS.RegisterModelAgentFactory("HelloModelAgent", CreateHelloModelAgent)
+	SOMACS.RegisterObserverAgentFactory("HelloObserverAgent", CreateHelloObserverAgent)
+	config, err := SOMACS.LoadServerConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	serv, err := SOMACS.CreateServerFromConfig(config)
+	if err != nil {
+		return nil, err
 	}
+	isExampleSynchronous = config.InternalMessagesSynchronous
+	setupHelloServer(serv)
+	return serv, nil
+}
+
+func updateShuffleTimer(serv *SOMACS.Server) {
+	environment := serv.GetEnvironment()
+	timer, _, _ := SOMACS.GetVariableAs(environment, "ShuffleTimer", shuffleTimerCodec)
+	if timer == 0 {
+		SOMACS.SetVariableTyped(environment, "ShuffleTimer", shuffleTimerCodec, timeBetweenShuffles)
+		return
+	}
+	SOMACS.SetVariableTyped(environment, "ShuffleTimer", shuffleTimerCodec, timer-1)
+}
+
+func setupHelloServer(serv *SOMACS.Server) {
+	serv.SetLogger(exampleLogger)
+	serv.SetMetaAgentRestoreFunc(
+		func(serv *SOMACS.Server, modelAgents []*SOMACS.ModelAgent, _ []*SOMACS.MetaAgent) SOMACS.MetaAgentDefinition {
+			return createHelloMetaAgentDefinition(serv, modelAgents)
+		},
+	)
+	if _, ok := serv.GetEnvironmentVariable("ShuffleTimer"); !ok {
+		SOMACS.SetEnvironmentVariableTyped(serv, "ShuffleTimer", shuffleTimerCodec, timeBetweenShuffles)
+	}
+	onUpdateEnvironment := updateShuffleTimer
 	serv.OnUpdateEnvironment.Subscribe(&onUpdateEnvironment)
 
 	onIterationFinished := func(serv *SOMACS.Server) {
@@ -332,9 +508,15 @@ func CreateHelloServer(numAgents, iterations int, maxDuration time.Duration, age
 		}
 	}
 	serv.OnIterationFinished.Subscribe(&onIterationFinished)
-	serv.SetInternalMessagesSynchronous(isExampleSynchronous)
+}
 
-	return serv
+// States count received "World" messages, uint16 so clusters of more than 255 agents do not overflow
+var helloStateCodec = SOMACS.BinaryCodec[uint16]{}
+var shuffleTimerCodec = SOMACS.BinaryCodec[uint8]{}
+
+func decodeHelloState(state []byte) uint16 {
+	value, _ := helloStateCodec.Decode(state)
+	return value
 }
 
 // Global variables used for testing
@@ -343,8 +525,19 @@ var spawnObservers = 1
 var evaluateVerbose = true
 var explainabilityVerbose = false
 var printHierarchy = true
-var timeBetweenShuffles = byte(5)
+var timeBetweenShuffles = uint8(5)
+var metaAgentCooldown = 0        // Iterations a dissolved cluster is not subsumed again
+var metaAgentStabilityWindow = 0 // Iterations a cluster has to be predicted in a row before it is subsumed, 0 or 1 subsumes it right away
+var metaAgentDissolveMode = SOMACS.DISSOLVE_MODE_ALL
 var isExampleSynchronous = true
+var helloPredictor = ""       // Replaces the hand-written predict if set: "last", "mean", "regression" or "knn"
+var helloClustering = ""      // Replaces the greedy grouping if set: "components", "louvain", "labels", "kmeans", "dbscan" or "scc"
+var helloStatisticsWindow = 1 // Iterations the "scc" clustering looks back on
+var helloSeriesLength = 0     // Iterations the states of a cluster have to be stationary over before it is subsumed, 0 skips the check
+var exampleLogger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+// Set by the open example, newcomers would otherwise be subsumed right before their cluster is shuffled
+var skipSchedulingBeforeShuffle = false
 
 func CreateExampleSim() {
 	serv := CreateHelloServer(200, 10, 100*time.Millisecond, 1000)
@@ -352,6 +545,134 @@ func CreateExampleSim() {
 	serv.Start()
 }
 
+func CreateExampleSimFromFile() {
+	serv, err := CreateHelloServerFromFile("ExampleScenario.yaml")
+	if err != nil {
+		fmt.Printf("Could not load scenario: %v\n", err)
+		return
+	}
+	serv.ReportMessagingDiagnostics()
+	serv.Start()
+}
+
+// Same scenario file with a seed, so agent ids and the agents' RNGs repeat from run to run and all messages are
+// delivered synchronously
+func CreateSeededExampleSimFromFile() {
+	serv, err := CreateHelloServerFromFile("ExampleSeededScenario.yaml")
+	if err != nil {
+		fmt.Printf("Could not load scenario: %v\n", err)
+		return
+	}
+	serv.ReportMessagingDiagnostics()
+	serv.Start()
+}
+
+// Agents live on six separate islands and only greet agents of their cluster on the same island, so meta agents
+// form per island and cluster
+func CreateSpatialExampleSim() {
+	serv := CreateHelloServer(200, 10, 100*time.Millisecond, 1000)
+	space := SOMACS.CreateGridSpace(30, 20, false)
+	serv.SetSpace(space, 2)
+	for i, id := range serv.GetModelAgents() {
+		ma := serv.GetModelAgentMap()[id]
+		island := i % 6
+		x := 5 + 10*(island%3) + ma.GetRand().Intn(3) - 1
+		y := 5 + 10*(island/3) + ma.GetRand().Intn(3) - 1
+		ma.SetPosition(SOMACS.Position{X: float64(x), Y: float64(y)})
+	}
+	serv.ReportMessagingDiagnostics()
+	serv.Start()
+}
+
+// Agents sit on a small world graph and only greet agents of their cluster they are connected to, partner search
+// sends (200 * 20) requests per iteration instead of (200 * 199)
+func CreateTopologyExampleSim() {
+	serv := CreateHelloServer(200, 10, 100*time.Millisecond, 1000)
+	topology, err := SOMACS.CreateSmallWorldTopology(serv.GetModelAgents(), 20, 0.1, rand.New(rand.NewSource(1)))
+	if err != nil {
+		fmt.Printf("Could not create topology: %v\n", err)
+		return
+	}
+	serv.SetTopology(topology)
+	serv.ReportMessagingDiagnostics()
+	serv.Start()
+}
+
+// Ten agents leave and ten newcomers join every iteration, meta agents losing members shrink or dissolve
+func CreateOpenExampleSim() {
+	skipSchedulingBeforeShuffle = true
+	serv := CreateHelloServer(200, 10, 100*time.Millisecond, 1000)
+	rng := rand.New(rand.NewSource(1))
+	onIterationFinished := func(serv *SOMACS.Server) {
+		modelAgents := serv.GetModelAgents()
+		for _, i := range rng.Perm(len(modelAgents))[:10] {
+			serv.RemoveModelAgent(modelAgents[i])
+			serv.SpawnModelAgent(CreateHelloModelAgent)
+		}
+	}
+	serv.OnIterationFinished.Subscribe(&onIterationFinished)
+	serv.ReportMessagingDiagnostics()
+	serv.Start()
+}
+
+// Meta agents predict with a linear regression fitted on what the observer saw before creating them
+func CreatePredictorExampleSim() {
+	helloPredictor = "regression"
+	serv := CreateHelloServer(200, 10, 100*time.Millisecond, 1000)
+	serv.ReportMessagingDiagnostics()
+	serv.Start()
+}
+
+// Clusters are only subsumed once predicted in two iterations in a row and not again in the iteration after they
+// dissolved, so meta agents churn less while the clusters are being shuffled
+func CreateStableExampleSim() {
+	metaAgentCooldown = 1
+	metaAgentStabilityWindow = 2
+	serv := CreateHelloServer(200, 10, 100*time.Millisecond, 1000)
+	serv.ReportMessagingDiagnostics()
+	serv.Start()
+}
+
+// Meta agents failing verification only release the members whose states were predicted wrongly and keep the rest
+func CreateEjectExampleSim() {
+	metaAgentDissolveMode = SOMACS.DISSOLVE_MODE_EJECT
+	serv := CreateHelloServer(200, 10, 100*time.Millisecond, 1000)
+	serv.ReportMessagingDiagnostics()
+	serv.Start()
+}
+
+// Writes one JSON line per iteration, s. SOMACS.TraceRecord for the fields. Messages are needed by ReplayExampleTrace
+func CreateTracedExampleSim() {
+	serv := CreateHelloServer(200, 10, 100*time.Millisecond, 1000)
+	traceRecorder, err := SOMACS.CreateTraceRecorderFile("ExampleTrace.jsonl")
+	if err != nil {
+		fmt.Printf("Could not create trace file: %v\n", err)
+		return
+	}
+	traceRecorder.SetRecordMessages(true)
+	serv.SetTraceRecorder(traceRecorder)
+	serv.Start()
+	if err := traceRecorder.Close(); err != nil {
+		fmt.Printf("Trace incomplete: %v\n", err)
+	}
+}
+
+// Runs the cluster detection of the observer on the trace written by CreateTracedExampleSim
+func ReplayExampleTrace() {
+	replay, err := SOMACS.LoadReplayFile("ExampleTrace.jsonl")
+	if err != nil {
+		fmt.Printf("Could not load trace: %v\n", err)
+		return
+	}
+	onAfterAllStateUpdatesReceived := func(statistics *SOMACS.ObserverStatistics) {
+		groups := predictHelloMessagingGroups(statistics, replay.GetObservedModelAgents())
+		fmt.Printf("Iteration %v: (%v) agents observed, (%v) groups predicted\n",
+			replay.GetIteration(), len(replay.GetObservedModelAgents()), len(groups))
+	}
+	replay.OnAfterAllStateUpdatesReceived.Subscribe(&onAfterAllStateUpdatesReceived)
+	replay.Play()
+}
+
 func PressEnterToExit() {
 	fmt.Println("Press [Enter] to exit...")
 
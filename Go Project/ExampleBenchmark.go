@@ -1,11 +1,16 @@
 package main
 
 import (
+	"GRL1/SOMACS"
 	"fmt"
 	"time"
 )
 
 var accuracyList = make([]float32, 0, 250)
+var shadowErrorList = make([]float64, 0, 250)
+var shadowMatchList = make([]float64, 0, 250)
+var dissolveReasonCounts = make(map[SOMACS.DissolveReason]int)
+var measureShadowFidelity = false
 var durationMap = make(map[int][]time.Duration)
 
 func benchmarkComputationalCost() {
@@ -49,15 +54,30 @@ func benchmarkRunComputationalCost() {
 	fmt.Printf("]\n")
 }
 
+// Accuracies are estimated by the evaluate function of the meta agents, shadow errors compare the predictions with the
+// states the subsumed agents computed themselves
 func benchmarkFidelity() {
 	spawnObservers = 1
+	measureShadowFidelity = true
 	benchmarkRunFidelity()
+	measureShadowFidelity = false
 
 	fmt.Printf("Accuracies: [")
 	for _, accuracy := range accuracyList {
 		fmt.Printf("%v\t", accuracy)
 	}
 	fmt.Printf("]\n")
+	fmt.Printf("Shadow Mean Absolute Errors: [")
+	for _, shadowError := range shadowErrorList {
+		fmt.Printf("%.2f\t", shadowError)
+	}
+	fmt.Printf("]\n")
+	fmt.Printf("Shadow Exact Match Rates: [")
+	for _, shadowMatch := range shadowMatchList {
+		fmt.Printf("%.2f\t", shadowMatch)
+	}
+	fmt.Printf("]\n")
+	fmt.Printf("Dissolve Reasons: %v\n", dissolveReasonCounts)
 }
 
 func benchmarkRunFidelity() {
@@ -77,6 +97,20 @@ func benchmarkSetup(numAgents, bandwidth, messageGroups int) {
 	fmt.Printf("Simulating for (%v) Model agents, (%v) bandwidth, (%v) message groups\n", numAgents, bandwidth, messageGroups)
 	numClusters = messageGroups
 	serv := CreateHelloMetaServer(numAgents, 10, 100*time.Millisecond, bandwidth)
+	if measureShadowFidelity {
+		serv.SetShadowMode(true, SOMACS.NumericStateDistance(helloStateCodec))
+		onShadowReportsReady := func(reports []SOMACS.ShadowReport) {
+			for _, report := range reports {
+				shadowErrorList = append(shadowErrorList, report.MeanAbsoluteError)
+				shadowMatchList = append(shadowMatchList, report.ExactMatchRate)
+			}
+		}
+		serv.OnShadowReportsReady.Subscribe(&onShadowReportsReady)
+		onMetaAgentDissolved := func(event SOMACS.MetaAgentEvent) {
+			dissolveReasonCounts[event.Reason]++
+		}
+		serv.OnMetaAgentDissolved.Subscribe(&onMetaAgentDissolved)
+	}
 	serv.Start()
 	end := time.Now()
 	//fmt.Printf("Duration : (%v)\n", end.Sub(start))
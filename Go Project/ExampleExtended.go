@@ -16,19 +16,27 @@ type HelloMetaObserverAgent struct {
 
 func CreateHelloMetaObserverAgent(serv *SOMACS.Server) SOMACS.IGenericAgent {
 	hoa := &HelloMetaObserverAgent{ObserverAgent: SOMACS.CreateObserverAgentBase(serv)}
+	hoa.setupHelloMetaObserverAgent()
+	return hoa
+}
 
+func (hoa *HelloMetaObserverAgent) Clone(serv *SOMACS.Server) SOMACS.IGenericAgent {
+	clone := &HelloMetaObserverAgent{ObserverAgent: hoa.CloneObserverAgentBase(serv)}
+	clone.setupHelloMetaObserverAgent()
+	return clone
+}
+
+func (hoa *HelloMetaObserverAgent) setupHelloMetaObserverAgent() {
 	hoa.SetObservationStrategy(
 		func() (*[]uuid.UUID, *[]uuid.UUID) {
 			metaAgents := make([]uuid.UUID, len(hoa.GetServer().GetMetaAgents()))
-			copy(metaAgents, serv.GetMetaAgents())
+			copy(metaAgents, hoa.GetServer().GetMetaAgents())
 			return nil, &metaAgents
 		},
 	)
 
 	onAfterAllStateUpdatesReceived := hoa.CreateMetaAgent
 	hoa.ObserverAgent.OnAfterAllStateUpdatesReceived.Subscribe(&onAfterAllStateUpdatesReceived)
-
-	return hoa
 }
 
 func (hoa *HelloMetaObserverAgent) CreateMetaAgent(statistics *SOMACS.ObserverStatistics) {
@@ -79,8 +87,8 @@ func (hoa *HelloMetaObserverAgent) CreateMetaAgent(statistics *SOMACS.ObserverSt
 		return state.GetModelStatesRecursive()
 	}
 	verify := func(messageStatistics *SOMACS.MessageStatistics, state *SOMACS.MetaState, baseState map[uuid.UUID][]byte) bool {
-		shuffleTimer, _ := hoa.GetServer().GetEnvironmentVariable("ShuffleTimer")
-		if shuffleTimer[0] <= 1 {
+		shuffleTimer, _, _ := SOMACS.GetEnvironmentVariableAs(hoa.GetServer(), "ShuffleTimer", shuffleTimerCodec)
+		if shuffleTimer <= 1 {
 			return false
 		}
 		return true
@@ -94,15 +102,9 @@ func CreateHelloMetaServer(numAgents, iterations int, maxDuration time.Duration,
 	serv := SOMACS.CreateServer([]int{numAgents}, []func(*SOMACS.Server) SOMACS.IGenericAgent{CreateHelloModelAgent},
 		[]int{1, 1}, []func(*SOMACS.Server) SOMACS.IGenericAgent{CreateHelloObserverAgent, CreateHelloMetaObserverAgent},
 		3, iterations, maxDuration, agentBandwidth)
-	serv.SetEnvironmentVariable("ShuffleTimer", []byte{timeBetweenShuffles})
-	onUpdateEnvironment := func(serv *SOMACS.Server) {
-		timer, _ := serv.GetEnvironmentVariable("ShuffleTimer")
-		if timer[0] == 0 {
-			serv.SetEnvironmentVariable("ShuffleTimer", []byte{timeBetweenShuffles})
-			return
-		}
-		serv.SetEnvironmentVariable("ShuffleTimer", []byte{timer[0] - 1})
-	}
+	serv.SetLogger(exampleLogger)
+	SOMACS.SetEnvironmentVariableTyped(serv, "ShuffleTimer", shuffleTimerCodec, timeBetweenShuffles)
+	onUpdateEnvironment := updateShuffleTimer
 	serv.OnUpdateEnvironment.Subscribe(&onUpdateEnvironment)
 	onIterationFinished := func(serv *SOMACS.Server) {
 		for _, ma := range serv.GetMetaAgentMap() {
@@ -131,3 +133,25 @@ func CreateLargeExtendedExampleSim() {
 	serv.ReportMessagingDiagnostics()
 	serv.Start()
 }
+
+// Instead of subsuming the clusters under an iteration II meta agent, top level meta agents are merged pairwise, so
+// the hierarchy stays one level deep
+func CreateMergeExampleSim() {
+	serv := CreateHelloServer(200, 10, 100*time.Millisecond, 1000)
+	onIterationFinished := func(serv *SOMACS.Server) {
+		topLevel := make([]uuid.UUID, 0)
+		for _, node := range serv.GetMetaHierarchy().RootNodes {
+			if _, ok := serv.GetMetaAgentMap()[node.Id]; ok {
+				topLevel = append(topLevel, node.Id)
+			}
+		}
+		for i := 0; i+1 < len(topLevel); i += 2 {
+			if err := serv.MergeMetaAgents(topLevel[i], topLevel[i+1]); err != nil {
+				fmt.Printf("Could not merge meta agents: %v\n", err)
+			}
+		}
+	}
+	serv.OnIterationFinished.Subscribe(&onIterationFinished)
+	serv.ReportMessagingDiagnostics()
+	serv.Start()
+}
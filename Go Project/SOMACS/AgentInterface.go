@@ -2,6 +2,8 @@ package SOMACS
 
 import (
 	"github.com/MattSScott/basePlatformSOMAS/v2/pkg/agent"
+	"github.com/MattSScott/basePlatformSOMAS/v2/pkg/message"
+	"github.com/google/uuid"
 )
 
 type IGenericAgent interface {
@@ -14,4 +16,77 @@ type IGenericAgent interface {
 	handleMainCommunicationPhase()
 	setupStateUpdatePhase()
 	handleStateUpdatePhase()
+	setupPhase(string)
+	handlePhase(string)
+}
+
+// Agent types that embed ModelAgent or ObserverAgent implement this to take part in resimulation. Clone should start
+// from CloneModelAgentBase / CloneObserverAgentBase and set up the agent's functions and subscriptions against the copy.
+type Cloneable interface {
+	Clone(*Server) IGenericAgent
+}
+
+// Messaging base of all agents, it behaves like the platform base agent but takes its id from the server, so clones
+// keep the id of the agent they copy
+type BaseAgent struct {
+	agent.IExposedServerFunctions[IGenericAgent]
+	id                      uuid.UUID
+	messageLimiterSemaphore chan struct{}
+}
+
+func createBaseAgent(serv *Server, id uuid.UUID) *BaseAgent {
+	return &BaseAgent{serv, id, make(chan struct{}, serv.GetAgentMessagingBandwidth())}
+}
+
+func (ba *BaseAgent) GetID() uuid.UUID {
+	return ba.id
+}
+
+func (ba *BaseAgent) CreateBaseMessage() message.BaseMessage {
+	return message.BaseMessage{Sender: ba.id}
+}
+
+func (ba *BaseAgent) SignalMessagingComplete() {
+	go ba.AgentStoppedTalking(ba.id)
+}
+
+// Dropped if the agent already has as many messages in flight as the bandwidth allows
+func (ba *BaseAgent) SendMessage(msg message.IMessage[IGenericAgent], recipient uuid.UUID) {
+	if msg.GetSender() == uuid.Nil {
+		panic("No sender found - did you compose the BaseMessage?")
+	}
+	status := false
+	select {
+	case ba.messageLimiterSemaphore <- struct{}{}:
+		go func() {
+			ba.DeliverMessage(msg, recipient)
+			<-ba.messageLimiterSemaphore
+		}()
+		status = true
+	default:
+	}
+	ba.GetDiagnosticEngine().ReportSendMessageStatus(status)
+}
+
+func (ba *BaseAgent) SendSynchronousMessage(msg message.IMessage[IGenericAgent], recipient uuid.UUID) {
+	if msg.GetSender() == uuid.Nil {
+		panic("No sender found - did you compose the BaseMessage?")
+	}
+	ba.DeliverMessage(msg, recipient)
+}
+
+func (ba *BaseAgent) BroadcastMessage(msg message.IMessage[IGenericAgent]) {
+	for id := range ba.ViewAgentIdSet() {
+		if id != msg.GetSender() {
+			ba.SendMessage(msg, id)
+		}
+	}
+}
+
+func (ba *BaseAgent) BroadcastSynchronousMessage(msg message.IMessage[IGenericAgent]) {
+	for id := range ba.ViewAgentIdSet() {
+		if id != msg.GetSender() {
+			ba.SendSynchronousMessage(msg, id)
+		}
+	}
 }
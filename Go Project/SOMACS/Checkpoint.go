@@ -0,0 +1,513 @@
+package SOMACS
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"maps"
+	"slices"
+)
+
+const CHECKPOINT_VERSION = 1
+
+type Checkpoint struct {
+	Version              int
+	Iteration            int
+	ModelAgents          []uuid.UUID
+	ObserverAgents       []uuid.UUID
+	ModelStates          map[uuid.UUID][]byte
+	EnvironmentVariables map[string][]byte
+	StateMemory          []map[uuid.UUID][]byte
+	EnvironmentMemory    []map[string][]byte
+	EnvironmentHistory   []EnvironmentSnapshot     `json:",omitempty"`
+	Positions            map[uuid.UUID]Position    `json:",omitempty"` // Only if the server has a space
+	Topology             map[uuid.UUID][]uuid.UUID `json:",omitempty"` // Only if the server has a topology
+	MetaAgentMemory      [][]MetaAgentSnapshot
+	HierarchyMemory      [][]MetaHierarchySnapshot
+	MetaHierarchy        []MetaHierarchySnapshot
+	MetaAgents           []MetaAgentSnapshot // In creation order, subsumed meta agents always precede their parent
+	Observers            []ObserverSnapshot
+	DissolvedGroups      []DissolvedGroupSnapshot `json:",omitempty"` // Only groups still within the cooldown
+}
+
+type MetaAgentSnapshot struct {
+	Id                  uuid.UUID
+	SubsumedModelAgents []uuid.UUID
+	SubsumedMetaAgents  []uuid.UUID
+	ModelStates         map[uuid.UUID][]byte
+	BaseState           map[uuid.UUID][]byte
+	HasDissolved        bool
+	CreatedAt           int `json:",omitempty"` // Iteration the meta agent was created in, starting at 0
+
+	definition    MetaAgentDefinition // Only available within the process that took the snapshot
+	hasDefinition bool
+}
+
+type ObserverSnapshot struct {
+	Id                  uuid.UUID
+	ObservedModelAgents []uuid.UUID
+	ObservedMetaAgents  []uuid.UUID
+	GroupSightings      []GroupSightingSnapshot       `json:",omitempty"` // Groups on their way through the stability window
+	History             []IterationStatisticsSnapshot `json:",omitempty"` // Oldest first, s. ObserverStatistics.SetWindow
+	StateSeries         map[uuid.UUID][]StateSample   `json:",omitempty"`
+}
+
+type DissolvedGroupSnapshot struct {
+	ModelAgents []uuid.UUID
+	Iteration   int
+}
+
+type GroupSightingSnapshot struct {
+	ModelAgents   []uuid.UUID
+	LastIteration int
+	Count         int
+}
+
+type IterationStatisticsSnapshot struct {
+	Iteration     int
+	Messages      []TracedMessage // Sorted by sender and recipient, in recording order between the two
+	Signaled      []uuid.UUID     // Agents that signaled the end of the main messaging phase
+	ModelStates   map[uuid.UUID][]byte
+	MetaStates    map[uuid.UUID]*MetaState
+	MetaDissolved map[uuid.UUID]bool
+}
+
+func (serv *Server) createCheckpoint() *Checkpoint {
+	cp := &Checkpoint{
+		Version:              CHECKPOINT_VERSION,
+		Iteration:            serv.iteration,
+		ModelAgents:          slices.Clone(serv.modelAgents),
+		ObserverAgents:       slices.Clone(serv.observerAgents),
+		ModelStates:          make(map[uuid.UUID][]byte, len(serv.modelAgents)),
+		EnvironmentVariables: serv.environment.GetAll(),
+		StateMemory:          serv.stateMemory,
+		EnvironmentMemory:    serv.environmentMemory,
+		EnvironmentHistory:   serv.environment.GetHistory(),
+		MetaAgentMemory:      serv.metaAgentMemory,
+		HierarchyMemory:      serv.hierarchyMemory,
+		MetaHierarchy:        serv.metaHierarchy.snapshot(),
+		MetaAgents:           serv.snapshotMetaAgents(),
+		Observers:            make([]ObserverSnapshot, 0, len(serv.observerAgents)),
+	}
+	for id, ag := range serv.modelAgentMap {
+		cp.ModelStates[id] = ag.state
+	}
+	if serv.partnerScope.topology != nil {
+		cp.Topology = serv.partnerScope.topology.GetAdjacency()
+	}
+	if serv.partnerScope.space != nil {
+		cp.Positions = make(map[uuid.UUID]Position, len(serv.modelAgents))
+		for _, id := range serv.modelAgents {
+			if position, ok := serv.partnerScope.space.GetPosition(id); ok {
+				cp.Positions[id] = position
+			}
+		}
+	}
+	for _, id := range serv.observerAgents {
+		oa := serv.observerAgentMap[id]
+		snapshot := ObserverSnapshot{
+			Id:                  id,
+			ObservedModelAgents: slices.Clone(*oa.observedModelAgents),
+			ObservedMetaAgents:  slices.Clone(*oa.observedMetaAgents),
+			History:             make([]IterationStatisticsSnapshot, len(oa.statistics.history)),
+			StateSeries:         make(map[uuid.UUID][]StateSample, len(oa.statistics.StateStatistics.series)),
+		}
+		for _, key := range slices.Sorted(maps.Keys(oa.groupSightings)) {
+			sighting := oa.groupSightings[key]
+			snapshot.GroupSightings = append(snapshot.GroupSightings, GroupSightingSnapshot{parseGroupKey(key), sighting.lastIteration, sighting.count})
+		}
+		for i, statistics := range oa.statistics.history {
+			snapshot.History[i] = statistics.checkpoint()
+		}
+		for agent, samples := range oa.statistics.StateStatistics.series {
+			snapshot.StateSeries[agent] = slices.Clone(samples)
+		}
+		cp.Observers = append(cp.Observers, snapshot)
+	}
+	for _, key := range slices.Sorted(maps.Keys(serv.dissolvedGroups)) {
+		cp.DissolvedGroups = append(cp.DissolvedGroups, DissolvedGroupSnapshot{parseGroupKey(key), serv.dissolvedGroups[key]})
+	}
+	return cp
+}
+
+func (is *IterationStatistics) checkpoint() IterationStatisticsSnapshot {
+	ms, ss := is.MessageStatistics, is.StateStatistics
+	snapshot := IterationStatisticsSnapshot{
+		Iteration:     is.Iteration,
+		Messages:      make([]TracedMessage, 0),
+		Signaled:      make([]uuid.UUID, 0, len(ms.hasSignaledMainMessagingComplete)),
+		ModelStates:   maps.Clone(ss.states),
+		MetaStates:    make(map[uuid.UUID]*MetaState, len(ss.metaStates)),
+		MetaDissolved: maps.Clone(ss.metaDissolved),
+	}
+	for _, sender := range sortedIDs(ms.communicationMap) {
+		for _, recipient := range sortedIDs(ms.communicationMap[sender]) {
+			for i, msg := range ms.communicationMap[sender][recipient] {
+				snapshot.Messages = append(snapshot.Messages, TracedMessage{ms.phaseMap[sender][recipient][i], sender, recipient, msg.MessageType, msg.Data})
+			}
+		}
+	}
+	for _, id := range sortedIDs(ms.hasSignaledMainMessagingComplete) {
+		if ms.hasSignaledMainMessagingComplete[id] {
+			snapshot.Signaled = append(snapshot.Signaled, id)
+		}
+	}
+	for id, state := range ss.metaStates {
+		snapshot.MetaStates[id] = state.clone()
+	}
+	return snapshot
+}
+
+func (is IterationStatisticsSnapshot) restore(idMap map[uuid.UUID]uuid.UUID) *IterationStatistics {
+	restored := &IterationStatistics{is.Iteration, &MessageStatistics{}, &StateStatistics{}}
+	restored.MessageStatistics.createMessageStatistics()
+	restored.StateStatistics.createStateStatistics()
+	for _, traced := range is.Messages {
+		msg := Message{MessageType: traced.MessageType, Data: traced.Data, Recipient: remapID(idMap, traced.Recipient)}
+		msg.Sender = remapID(idMap, traced.Sender)
+		restored.MessageStatistics.recordMessage(msg, traced.Phase)
+	}
+	for _, id := range is.Signaled {
+		restored.MessageStatistics.recordSignaledMainMessagingComplete(remapID(idMap, id))
+	}
+	for id, state := range is.ModelStates {
+		restored.StateStatistics.states[remapID(idMap, id)] = state
+	}
+	for id, state := range is.MetaStates {
+		restored.StateStatistics.recordMeta(remapID(idMap, id), remapMetaState(idMap, state), is.MetaDissolved[id])
+	}
+	return restored
+}
+
+func remapMetaState(idMap map[uuid.UUID]uuid.UUID, state *MetaState) *MetaState {
+	if state == nil {
+		return nil
+	}
+	remapped := &MetaState{make(map[uuid.UUID]*MetaState, len(state.ChildStates)), make(map[uuid.UUID][]byte, len(state.ModelStates))}
+	for id, child := range state.ChildStates {
+		remapped.ChildStates[remapID(idMap, id)] = remapMetaState(idMap, child)
+	}
+	for id, modelState := range state.ModelStates {
+		remapped.ModelStates[remapID(idMap, id)] = modelState
+	}
+	return remapped
+}
+
+func remapIDs(idMap map[uuid.UUID]uuid.UUID, ids []uuid.UUID) []uuid.UUID {
+	remapped := make([]uuid.UUID, len(ids))
+	for i, id := range ids {
+		remapped[i] = remapID(idMap, id)
+	}
+	return remapped
+}
+
+// Ids missing from idMap are kept as they are
+func remapID(idMap map[uuid.UUID]uuid.UUID, id uuid.UUID) uuid.UUID {
+	if newId, ok := idMap[id]; ok {
+		return newId
+	}
+	return id
+}
+
+// Ids missing from idMap are kept as they are
+func (ms MetaAgentSnapshot) remap(idMap map[uuid.UUID]uuid.UUID) MetaAgentSnapshot {
+	remapStates := func(states map[uuid.UUID][]byte) map[uuid.UUID][]byte {
+		remapped := make(map[uuid.UUID][]byte, len(states))
+		for id, state := range states {
+			remapped[remapID(idMap, id)] = state
+		}
+		return remapped
+	}
+	remapped := ms
+	remapped.Id = remapID(idMap, ms.Id)
+	remapped.SubsumedModelAgents = remapIDs(idMap, ms.SubsumedModelAgents)
+	remapped.SubsumedMetaAgents = remapIDs(idMap, ms.SubsumedMetaAgents)
+	remapped.ModelStates = remapStates(ms.ModelStates)
+	remapped.BaseState = remapStates(ms.BaseState)
+	return remapped
+}
+
+func (serv *Server) snapshotMetaAgents() []MetaAgentSnapshot {
+	snapshots := make([]MetaAgentSnapshot, 0, len(serv.metaAgents))
+	for _, id := range serv.metaAgents {
+		ma := serv.metaAgentMap[id]
+		snapshot := MetaAgentSnapshot{
+			Id:                  id,
+			SubsumedModelAgents: make([]uuid.UUID, len(ma.subsumedModelAgents)),
+			SubsumedMetaAgents:  make([]uuid.UUID, len(ma.subsumedMetaAgents)),
+			ModelStates:         maps.Clone(ma.state.ModelStates),
+			BaseState:           maps.Clone(ma.condition.baseState),
+			HasDissolved:        ma.hasDissolved,
+			CreatedAt:           ma.createdAt,
+			definition:          ma.GetDefinition(),
+			hasDefinition:       true,
+		}
+		for i, ag := range ma.subsumedModelAgents {
+			snapshot.SubsumedModelAgents[i] = ag.GetID()
+		}
+		for i, ag := range ma.subsumedMetaAgents {
+			snapshot.SubsumedMetaAgents[i] = ag.GetID()
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
+
+// Removes all meta agents immediately, returns their definitions so they can be reused when restoring
+func (serv *Server) removeAllMetaAgents() map[uuid.UUID]MetaAgentDefinition {
+	definitions := make(map[uuid.UUID]MetaAgentDefinition, len(serv.metaAgents))
+	for _, id := range slices.Clone(serv.metaAgents) {
+		ma := serv.metaAgentMap[id]
+		definitions[id] = ma.GetDefinition()
+		serv.unsubsumeAgents(ma)
+		serv.deleteMetaAgent(ma)
+	}
+	return definitions
+}
+
+// Recreates meta agents from snapshots, idMap translates snapshot ids to live ids and is extended by the new meta agents
+func (serv *Server) restoreMetaAgents(snapshots []MetaAgentSnapshot, definitions map[uuid.UUID]MetaAgentDefinition, idMap map[uuid.UUID]uuid.UUID) {
+	for _, snapshot := range snapshots {
+		modelAgents := make([]*ModelAgent, 0, len(snapshot.SubsumedModelAgents))
+		for _, id := range snapshot.SubsumedModelAgents {
+			ag, ok := serv.modelAgentMap[idMap[id]]
+			if ok {
+				modelAgents = append(modelAgents, ag)
+			}
+		}
+		metaAgents := make([]*MetaAgent, 0, len(snapshot.SubsumedMetaAgents))
+		for _, id := range snapshot.SubsumedMetaAgents {
+			ag, ok := serv.metaAgentMap[idMap[id]]
+			if ok {
+				metaAgents = append(metaAgents, ag)
+			}
+		}
+		if len(modelAgents)+len(metaAgents) == 0 {
+			serv.logger.Warn("meta agent not restored, none of its members exist", "iteration", serv.iteration+1, "metaAgent", snapshot.Id)
+			continue
+		}
+
+		definition, ok := definitions[snapshot.Id]
+		if !ok && snapshot.hasDefinition {
+			definition, ok = snapshot.definition, true
+		}
+		if !ok && serv.restoreMetaAgentDefinition != nil {
+			definition, ok = serv.restoreMetaAgentDefinition(serv, modelAgents, metaAgents), true
+		}
+		if !ok {
+			serv.logger.Warn("meta agent not restored, its definition cannot be rebuilt", "iteration", serv.iteration+1, "metaAgent", snapshot.Id)
+			continue
+		}
+
+		ma := createMetaAgentFromDefinition(serv, modelAgents, metaAgents, definition).(*MetaAgent)
+		serv.AddAgent(ma)
+		for id, state := range snapshot.ModelStates {
+			if _, ok := ma.state.ModelStates[idMap[id]]; ok {
+				ma.state.ModelStates[idMap[id]] = state
+			}
+		}
+		ma.condition.baseState = make(map[uuid.UUID][]byte, len(snapshot.BaseState))
+		for id, state := range snapshot.BaseState {
+			ma.condition.baseState[idMap[id]] = state
+		}
+		ma.hasDissolved = snapshot.HasDissolved
+		ma.createdAt = snapshot.CreatedAt
+		idMap[snapshot.Id] = ma.GetID()
+	}
+}
+
+// Exposed Functions
+
+func (serv *Server) SaveCheckpoint(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(serv.createCheckpoint()); err != nil {
+		return fmt.Errorf("encoding checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Model and observer agents are matched with the checkpoint by creation order, so the server has to be created from
+// the same scenario. Meta agents are recreated with new ids, a server that did not create them needs
+// SetMetaAgentRestoreFunc. The space is replaced by a copy holding the restored positions. Cooldowns, the stability
+// window and the statistics windows continue where the checkpoint left them, their lengths stay the ones set on this
+// server. The server is left unchanged if the checkpoint cannot be restored.
+func (serv *Server) LoadCheckpoint(r io.Reader) error {
+	cp := &Checkpoint{}
+	if err := json.NewDecoder(r).Decode(cp); err != nil {
+		return fmt.Errorf("decoding checkpoint: %w", err)
+	}
+	if cp.Version != CHECKPOINT_VERSION {
+		return fmt.Errorf("unsupported checkpoint version (%v), expected (%v)", cp.Version, CHECKPOINT_VERSION)
+	}
+	if len(cp.ModelAgents) != len(serv.modelAgents) {
+		return fmt.Errorf("checkpoint contains (%v) model agents, server has (%v)", len(cp.ModelAgents), len(serv.modelAgents))
+	}
+	if len(cp.ObserverAgents) != len(serv.observerAgents) {
+		return fmt.Errorf("checkpoint contains (%v) observer agents, server has (%v)", len(cp.ObserverAgents), len(serv.observerAgents))
+	}
+
+	idMap := make(map[uuid.UUID]uuid.UUID, len(cp.ModelAgents)+len(cp.ObserverAgents)+len(cp.MetaAgents))
+	for i, id := range cp.ModelAgents {
+		idMap[id] = serv.modelAgents[i]
+	}
+	for i, id := range cp.ObserverAgents {
+		idMap[id] = serv.observerAgents[i]
+	}
+
+	// Everything that can fail is prepared before the server is changed
+	mapModelAgent := func(id uuid.UUID) (uuid.UUID, error) {
+		newId, ok := idMap[id]
+		if !ok || serv.modelAgentMap[newId] == nil {
+			return uuid.Nil, fmt.Errorf("agent (%v) is not a model agent of the checkpoint", id)
+		}
+		return newId, nil
+	}
+	var space Space
+	if serv.partnerScope.space != nil {
+		space = serv.partnerScope.space.Clone()
+		for id, position := range cp.Positions {
+			newId, err := mapModelAgent(id)
+			if err != nil {
+				return fmt.Errorf("restoring positions: %w", err)
+			}
+			if err := space.Place(newId, position); err != nil {
+				return fmt.Errorf("restoring position of agent (%v): %w", id, err)
+			}
+		}
+	}
+	var topology *Topology
+	if cp.Topology != nil {
+		adjacency := make(map[uuid.UUID][]uuid.UUID, len(cp.Topology))
+		for id, neighbours := range cp.Topology {
+			newId, err := mapModelAgent(id)
+			if err != nil {
+				return fmt.Errorf("restoring topology: %w", err)
+			}
+			adjacency[newId] = make([]uuid.UUID, len(neighbours))
+			for i, neighbour := range neighbours {
+				if adjacency[newId][i], err = mapModelAgent(neighbour); err != nil {
+					return fmt.Errorf("restoring topology: %w", err)
+				}
+			}
+		}
+		var err error
+		if topology, err = CreateTopologyFromAdjacency(adjacency); err != nil {
+			return fmt.Errorf("restoring topology: %w", err)
+		}
+	}
+	observedModelAgents := make([][]uuid.UUID, len(cp.Observers))
+	for i, snapshot := range cp.Observers {
+		if _, ok := serv.observerAgentMap[idMap[snapshot.Id]]; !ok {
+			return fmt.Errorf("agent (%v) is not an observer agent of the checkpoint", snapshot.Id)
+		}
+		observedModelAgents[i] = make([]uuid.UUID, 0, len(snapshot.ObservedModelAgents))
+		for _, id := range snapshot.ObservedModelAgents {
+			newId, err := mapModelAgent(id)
+			if err != nil {
+				return fmt.Errorf("restoring observer (%v): %w", snapshot.Id, err)
+			}
+			observedModelAgents[i] = append(observedModelAgents[i], newId)
+		}
+	}
+	// Definitions are not serialised, only meta agents still alive on this server bring their own
+	restorable := make(map[uuid.UUID]bool, len(cp.MetaAgents))
+	for _, snapshot := range cp.MetaAgents {
+		if _, ok := serv.metaAgentMap[snapshot.Id]; !ok && serv.restoreMetaAgentDefinition == nil {
+			return fmt.Errorf("meta agent (%v) cannot be restored without a definition, set one with SetMetaAgentRestoreFunc", snapshot.Id)
+		}
+		if len(snapshot.SubsumedModelAgents)+len(snapshot.SubsumedMetaAgents) == 0 {
+			return fmt.Errorf("meta agent (%v) cannot be restored without members", snapshot.Id)
+		}
+		for _, id := range snapshot.SubsumedModelAgents {
+			if _, err := mapModelAgent(id); err != nil {
+				return fmt.Errorf("restoring meta agent (%v): %w", snapshot.Id, err)
+			}
+		}
+		for _, id := range snapshot.SubsumedMetaAgents {
+			if !restorable[id] {
+				return fmt.Errorf("meta agent (%v) subsumes (%v), which does not precede it in the checkpoint", snapshot.Id, id)
+			}
+		}
+		restorable[snapshot.Id] = true
+	}
+
+	definitions := serv.removeAllMetaAgents()
+
+	for id, state := range cp.ModelStates {
+		ag, ok := serv.modelAgentMap[idMap[id]]
+		if ok {
+			ag.state = state
+		}
+	}
+	if space != nil {
+		serv.partnerScope.space = space
+	}
+	if topology != nil {
+		serv.SetTopology(topology)
+	}
+	serv.environment.restore(cp.EnvironmentVariables, cp.Iteration)
+	serv.environment.setHistory(cp.EnvironmentHistory)
+	serv.memoryMutex.Lock()
+	defer serv.memoryMutex.Unlock()
+	serv.environmentMemory = cp.EnvironmentMemory
+	serv.stateMemory = make([]map[uuid.UUID][]byte, len(cp.StateMemory))
+	for i, states := range cp.StateMemory {
+		serv.stateMemory[i] = make(map[uuid.UUID][]byte, len(states))
+		for id, state := range states {
+			serv.stateMemory[i][idMap[id]] = state
+		}
+	}
+	serv.iteration = cp.Iteration
+
+	serv.restoreMetaAgents(cp.MetaAgents, definitions, idMap)
+	serv.metaHierarchy.restoreSnapshot(cp.MetaHierarchy, idMap)
+
+	serv.metaAgentMemory = make([][]MetaAgentSnapshot, len(cp.MetaAgentMemory))
+	for i, snapshots := range cp.MetaAgentMemory {
+		serv.metaAgentMemory[i] = make([]MetaAgentSnapshot, len(snapshots))
+		for j, snapshot := range snapshots {
+			serv.metaAgentMemory[i][j] = snapshot.remap(idMap)
+		}
+	}
+	serv.hierarchyMemory = make([][]MetaHierarchySnapshot, len(cp.HierarchyMemory))
+	for i, nodes := range cp.HierarchyMemory {
+		serv.hierarchyMemory[i] = make([]MetaHierarchySnapshot, len(nodes))
+		for j, node := range nodes {
+			serv.hierarchyMemory[i][j] = node.remap(idMap)
+		}
+	}
+
+	for i, snapshot := range cp.Observers {
+		oa := serv.observerAgentMap[idMap[snapshot.Id]]
+		observedMetaAgents := make([]uuid.UUID, 0, len(snapshot.ObservedMetaAgents))
+		for _, id := range snapshot.ObservedMetaAgents {
+			if newId, ok := idMap[id]; ok {
+				observedMetaAgents = append(observedMetaAgents, newId)
+			}
+		}
+		oa.observedModelAgents = &observedModelAgents[i]
+		oa.observedMetaAgents = &observedMetaAgents
+
+		oa.groupSightings = make(map[string]groupSighting, len(snapshot.GroupSightings))
+		for _, sighting := range snapshot.GroupSightings {
+			oa.groupSightings[getGroupKey(remapIDs(idMap, sighting.ModelAgents))] = groupSighting{sighting.LastIteration, sighting.Count}
+		}
+		oa.statistics.history = make([]*IterationStatistics, len(snapshot.History))
+		for j, statistics := range snapshot.History {
+			oa.statistics.history[j] = statistics.restore(idMap)
+		}
+		oa.statistics.SetWindow(oa.statistics.window)
+		clear(oa.statistics.StateStatistics.series)
+		if oa.statistics.StateStatistics.seriesLength > 0 {
+			for id, samples := range snapshot.StateSeries {
+				oa.statistics.StateStatistics.series[remapID(idMap, id)] = slices.Clone(samples)
+			}
+		}
+	}
+	serv.dissolvedGroups = make(map[string]int, len(cp.DissolvedGroups))
+	for _, group := range cp.DissolvedGroups {
+		serv.dissolvedGroups[getGroupKey(remapIDs(idMap, group.ModelAgents))] = group.Iteration
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package SOMACS
+
+import (
+	"github.com/google/uuid"
+	"math"
+	"math/rand"
+	"slices"
+)
+
+// Group detection for observers, the groups can be passed to ObserverAgent.ScheduleMetaAgent as they are. Graph
+// based algorithms work on the messages between the given agents, state based ones on the decoded states of the
+// agents. Groups are sorted by id and so is each group, agents are processed in id order to keep runs reproducible.
+
+// Undirected, weighted by the number of messages in both directions
+type clusterGraph struct {
+	nodes     []uuid.UUID
+	adjacency []map[int]float64
+}
+
+func createClusterGraph(statistics *MessageStatistics, agents []uuid.UUID) *clusterGraph {
+	nodes := slices.Compact(slices.SortedFunc(slices.Values(agents), compareIDs))
+	index := make(map[uuid.UUID]int, len(nodes))
+	for i, id := range nodes {
+		index[id] = i
+	}
+	cg := &clusterGraph{nodes, make([]map[int]float64, len(nodes))}
+	for i := range cg.adjacency {
+		cg.adjacency[i] = make(map[int]float64)
+	}
+	for sender, recipients := range statistics.GetCommunicationGraph().total {
+		i, ok := index[sender]
+		if !ok {
+			continue
+		}
+		for recipient, weight := range recipients {
+			j, ok := index[recipient]
+			if !ok || i == j {
+				continue
+			}
+			cg.adjacency[i][j] += float64(weight)
+			cg.adjacency[j][i] += float64(weight)
+		}
+	}
+	return cg
+}
+
+// Neighbours in index order, map iteration order would make the algorithms nondeterministic
+func (cg *clusterGraph) getNeighbours(i int) []int {
+	neighbours := make([]int, 0, len(cg.adjacency[i]))
+	for j := range cg.adjacency[i] {
+		neighbours = append(neighbours, j)
+	}
+	slices.Sort(neighbours)
+	return neighbours
+}
+
+// Labels are indices into nodes, nodes sharing a label form a group
+func createGroups(nodes []uuid.UUID, labels []int) [][]uuid.UUID {
+	groupOf := make(map[int]int)
+	groups := make([][]uuid.UUID, 0)
+	for i, id := range nodes {
+		if labels[i] < 0 {
+			continue
+		}
+		g, ok := groupOf[labels[i]]
+		if !ok {
+			g = len(groups)
+			groupOf[labels[i]] = g
+			groups = append(groups, make([]uuid.UUID, 0))
+		}
+		groups[g] = append(groups[g], id)
+	}
+	return groups
+}
+
+// Exposed Functions
+
+// Agents connected by messages in either direction, directly or through other agents, form a group
+func ClusterConnectedComponents(statistics *MessageStatistics, agents []uuid.UUID) [][]uuid.UUID {
+	cg := createClusterGraph(statistics, agents)
+	labels := make([]int, len(cg.nodes))
+	for i := range labels {
+		labels[i] = -1
+	}
+	for i := range cg.nodes {
+		if labels[i] >= 0 {
+			continue
+		}
+		labels[i] = i
+		queue := []int{i}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			for _, j := range cg.getNeighbours(current) {
+				if labels[j] < 0 {
+					labels[j] = i
+					queue = append(queue, j)
+				}
+			}
+		}
+	}
+	return createGroups(cg.nodes, labels)
+}
+
+// Maximises the modularity of the communication graph, agents only exchanging few messages with the rest of their
+// component end up in separate groups
+func ClusterLouvain(statistics *MessageStatistics, agents []uuid.UUID) [][]uuid.UUID {
+	cg := createClusterGraph(statistics, agents)
+	membership := make([]int, len(cg.nodes))
+	for i := range membership {
+		membership[i] = i
+	}
+	adjacency := cg.adjacency
+	for {
+		communities, hasMoved := louvainLocalMoving(adjacency)
+		if !hasMoved {
+			break
+		}
+		// Communities become the nodes of the next level
+		renumbered := make(map[int]int)
+		for _, community := range communities {
+			if _, ok := renumbered[community]; !ok {
+				renumbered[community] = len(renumbered)
+			}
+		}
+		aggregated := make([]map[int]float64, len(renumbered))
+		for i := range aggregated {
+			aggregated[i] = make(map[int]float64)
+		}
+		for i, neighbours := range adjacency {
+			for j, weight := range neighbours {
+				aggregated[renumbered[communities[i]]][renumbered[communities[j]]] += weight
+			}
+		}
+		for i := range membership {
+			membership[i] = renumbered[communities[membership[i]]]
+		}
+		adjacency = aggregated
+	}
+	return createGroups(cg.nodes, membership)
+}
+
+// Moves nodes to the neighbouring community with the highest modularity gain until no move improves it
+func louvainLocalMoving(adjacency []map[int]float64) ([]int, bool) {
+	n := len(adjacency)
+	communities := make([]int, n)
+	degrees := make([]float64, n)
+	totals := make([]float64, n)
+	totalWeight := 0.0
+	for i, neighbours := range adjacency {
+		communities[i] = i
+		for _, weight := range neighbours {
+			degrees[i] += weight
+		}
+		totals[i] = degrees[i]
+		totalWeight += degrees[i]
+	}
+	if totalWeight == 0 {
+		return communities, false
+	}
+
+	hasMoved := false
+	for isImproving := true; isImproving; {
+		isImproving = false
+		for i := 0; i < n; i++ {
+			current := communities[i]
+			links := make(map[int]float64)
+			for j, weight := range adjacency[i] {
+				if j != i {
+					links[communities[j]] += weight
+				}
+			}
+			totals[current] -= degrees[i]
+			best, bestGain := current, links[current]-totals[current]*degrees[i]/totalWeight
+			candidates := make([]int, 0, len(links))
+			for community := range links {
+				candidates = append(candidates, community)
+			}
+			slices.Sort(candidates)
+			for _, community := range candidates {
+				gain := links[community] - totals[community]*degrees[i]/totalWeight
+				if gain > bestGain+1e-12 {
+					best, bestGain = community, gain
+				}
+			}
+			totals[best] += degrees[i]
+			if best != current {
+				communities[i] = best
+				isImproving = true
+				hasMoved = true
+			}
+		}
+	}
+	return communities, hasMoved
+}
+
+// Every agent repeatedly takes the label most of its neighbours (weighted by messages) carry, ties go to the lowest
+// label. The order agents update in is drawn from rng, iteration stops once no label changes.
+func ClusterLabelPropagation(statistics *MessageStatistics, agents []uuid.UUID, rng *rand.Rand, maxIterations int) [][]uuid.UUID {
+	cg := createClusterGraph(statistics, agents)
+	labels := make([]int, len(cg.nodes))
+	for i := range labels {
+		labels[i] = i
+	}
+	for iteration := 0; iteration < maxIterations; iteration++ {
+		hasChanged := false
+		for _, i := range rng.Perm(len(cg.nodes)) {
+			weights := make(map[int]float64)
+			for _, j := range cg.getNeighbours(i) {
+				weights[labels[j]] += cg.adjacency[i][j]
+			}
+			best, bestWeight := labels[i], weights[labels[i]]
+			for label, weight := range weights {
+				if weight > bestWeight || (weight == bestWeight && label < best) {
+					best, bestWeight = label, weight
+				}
+			}
+			if best != labels[i] {
+				labels[i] = best
+				hasChanged = true
+			}
+		}
+		if !hasChanged {
+			break
+		}
+	}
+	return createGroups(cg.nodes, labels)
+}
+
+// State based clustering
+
+// Agents without a recorded state are left out
+func decodeClusterStates[T Number](statistics *StateStatistics, codec StateCodec[T], agents []uuid.UUID) ([]uuid.UUID, []float64) {
+	states := statistics.GetStates()
+	nodes := make([]uuid.UUID, 0, len(agents))
+	values := make([]float64, 0, len(agents))
+	for _, id := range slices.Compact(slices.SortedFunc(slices.Values(agents), compareIDs)) {
+		data, ok := states[id]
+		if !ok {
+			continue
+		}
+		value, err := codec.Decode(data)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, id)
+		values = append(values, float64(value))
+	}
+	return nodes, values
+}
+
+// Groups agents into at most k groups of similar states, initial centres are picked with k-means++ from rng
+func ClusterKMeans[T Number](statistics *StateStatistics, codec StateCodec[T], agents []uuid.UUID, k int, rng *rand.Rand, maxIterations int) [][]uuid.UUID {
+	nodes, values := decodeClusterStates(statistics, codec, agents)
+	k = min(k, len(nodes))
+	if k < 1 {
+		return make([][]uuid.UUID, 0)
+	}
+
+	centres := []float64{values[rng.Intn(len(values))]}
+	distances := make([]float64, len(values))
+	for len(centres) < k {
+		sum := 0.0
+		for i, value := range values {
+			distances[i] = math.Inf(1)
+			for _, centre := range centres {
+				distances[i] = min(distances[i], (value-centre)*(value-centre))
+			}
+			sum += distances[i]
+		}
+		if sum == 0 {
+			break
+		}
+		target := rng.Float64() * sum
+		next := len(values) - 1
+		for i, distance := range distances {
+			target -= distance
+			if target < 0 {
+				next = i
+				break
+			}
+		}
+		centres = append(centres, values[next])
+	}
+
+	labels := make([]int, len(values))
+	for iteration := 0; iteration < maxIterations; iteration++ {
+		hasChanged := iteration == 0
+		for i, value := range values {
+			best := 0
+			for c, centre := range centres {
+				if math.Abs(value-centre) < math.Abs(value-centres[best]) {
+					best = c
+				}
+			}
+			if labels[i] != best {
+				labels[i] = best
+				hasChanged = true
+			}
+		}
+		if !hasChanged {
+			break
+		}
+		sums := make([]float64, len(centres))
+		counts := make([]int, len(centres))
+		for i, value := range values {
+			sums[labels[i]] += value
+			counts[labels[i]]++
+		}
+		for c := range centres {
+			if counts[c] > 0 {
+				centres[c] = sums[c] / float64(counts[c])
+			}
+		}
+	}
+	return createGroups(nodes, labels)
+}
+
+// Agents with at least minPoints states (including their own) within eps form the core of a group, agents within eps
+// of a core agent join it. Agents reaching no core agent are noise and left out.
+func ClusterDBSCAN[T Number](statistics *StateStatistics, codec StateCodec[T], agents []uuid.UUID, eps float64, minPoints int) [][]uuid.UUID {
+	nodes, values := decodeClusterStates(statistics, codec, agents)
+	getNeighbourhood := func(i int) []int {
+		neighbourhood := make([]int, 0)
+		for j, value := range values {
+			if math.Abs(values[i]-value) <= eps {
+				neighbourhood = append(neighbourhood, j)
+			}
+		}
+		return neighbourhood
+	}
+
+	const unvisited, noise = -2, -1
+	labels := make([]int, len(values))
+	for i := range labels {
+		labels[i] = unvisited
+	}
+	for i := range values {
+		if labels[i] != unvisited {
+			continue
+		}
+		neighbourhood := getNeighbourhood(i)
+		if len(neighbourhood) < minPoints {
+			labels[i] = noise
+			continue
+		}
+		labels[i] = i
+		for len(neighbourhood) > 0 {
+			j := neighbourhood[0]
+			neighbourhood = neighbourhood[1:]
+			if labels[j] == noise {
+				labels[j] = i
+			}
+			if labels[j] != unvisited {
+				continue
+			}
+			labels[j] = i
+			if expansion := getNeighbourhood(j); len(expansion) >= minPoints {
+				neighbourhood = append(neighbourhood, expansion...)
+			}
+		}
+	}
+	return createGroups(nodes, labels)
+}
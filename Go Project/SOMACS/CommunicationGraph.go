@@ -0,0 +1,258 @@
+package SOMACS
+
+import (
+	"github.com/google/uuid"
+	"slices"
+)
+
+// Directed communication graph built from the recorded messages, edges are weighted by the number of messages sent
+// along them. Degrees, clustering and reciprocity ignore messages agents send to themselves, edge weights do not.
+type CommunicationGraph struct {
+	nodes   []uuid.UUID
+	weights map[uuid.UUID]map[uuid.UUID]map[int]int //map[from][to][messageType]count
+	total   map[uuid.UUID]map[uuid.UUID]int         //map[from][to]count
+}
+
+func createCommunicationGraph() *CommunicationGraph {
+	return &CommunicationGraph{make([]uuid.UUID, 0), make(map[uuid.UUID]map[uuid.UUID]map[int]int), make(map[uuid.UUID]map[uuid.UUID]int)}
+}
+
+func (cg *CommunicationGraph) addMessage(sender, recipient uuid.UUID, messageType int) {
+	if _, ok := cg.weights[sender]; !ok {
+		cg.weights[sender] = make(map[uuid.UUID]map[int]int)
+		cg.total[sender] = make(map[uuid.UUID]int)
+	}
+	if _, ok := cg.weights[sender][recipient]; !ok {
+		cg.weights[sender][recipient] = make(map[int]int)
+	}
+	cg.weights[sender][recipient][messageType]++
+	cg.total[sender][recipient]++
+}
+
+func (cg *CommunicationGraph) addNodes() {
+	nodes := make(map[uuid.UUID]bool)
+	for sender, recipients := range cg.total {
+		nodes[sender] = true
+		for recipient := range recipients {
+			nodes[recipient] = true
+		}
+	}
+	cg.nodes = sortedIDs(nodes)
+}
+
+func (ms *MessageStatistics) addToCommunicationGraph(cg *CommunicationGraph, phases []string) {
+	for sender, recipients := range ms.communicationMap {
+		for recipient, msgs := range recipients {
+			for i, msg := range msgs {
+				if len(phases) > 0 && !slices.Contains(phases, ms.phaseMap[sender][recipient][i]) {
+					continue
+				}
+				cg.addMessage(sender, recipient, msg.MessageType)
+			}
+		}
+	}
+}
+
+// Agents sharing an edge in either direction, in id order
+func (cg *CommunicationGraph) getNeighbours(agent uuid.UUID) []uuid.UUID {
+	neighbours := make(map[uuid.UUID]bool)
+	for _, id := range cg.nodes {
+		if id != agent && (cg.total[agent][id] > 0 || cg.total[id][agent] > 0) {
+			neighbours[id] = true
+		}
+	}
+	return sortedIDs(neighbours)
+}
+
+func (cg *CommunicationGraph) getSuccessors(agent uuid.UUID) []uuid.UUID {
+	successors := make(map[uuid.UUID]bool)
+	for id := range cg.total[agent] {
+		if id != agent {
+			successors[id] = true
+		}
+	}
+	return sortedIDs(successors)
+}
+
+// Exposed Functions
+
+// Graph of the messages recorded in the given phases, all phases if none are given
+func (ms *MessageStatistics) GetCommunicationGraph(phases ...string) *CommunicationGraph {
+	cg := createCommunicationGraph()
+	ms.addToCommunicationGraph(cg, phases)
+	cg.addNodes()
+	return cg
+}
+
+// Agents that sent or received at least one message, in id order
+func (cg *CommunicationGraph) GetNodes() []uuid.UUID {
+	return cg.nodes
+}
+
+func (cg *CommunicationGraph) GetEdgeWeight(sender, recipient uuid.UUID) int {
+	return cg.total[sender][recipient]
+}
+
+// Number of messages of any of the given types sent along the edge
+func (cg *CommunicationGraph) GetEdgeWeightOfType(sender, recipient uuid.UUID, msgTypes ...int) int {
+	weight := 0
+	for _, msgType := range msgTypes {
+		weight += cg.weights[sender][recipient][msgType]
+	}
+	return weight
+}
+
+// Edges of the graph only containing messages of the given types
+func (cg *CommunicationGraph) GetSubgraphOfType(msgTypes ...int) *CommunicationGraph {
+	subgraph := createCommunicationGraph()
+	for sender, recipients := range cg.weights {
+		for recipient, counts := range recipients {
+			for _, msgType := range msgTypes {
+				for range counts[msgType] {
+					subgraph.addMessage(sender, recipient, msgType)
+				}
+			}
+		}
+	}
+	subgraph.addNodes()
+	return subgraph
+}
+
+func (cg *CommunicationGraph) GetOutDegree(agent uuid.UUID) int {
+	return len(cg.getSuccessors(agent))
+}
+
+func (cg *CommunicationGraph) GetInDegree(agent uuid.UUID) int {
+	degree := 0
+	for _, id := range cg.nodes {
+		if id != agent && cg.total[id][agent] > 0 {
+			degree++
+		}
+	}
+	return degree
+}
+
+// Number of agents the agent communicated with in either direction
+func (cg *CommunicationGraph) GetDegree(agent uuid.UUID) int {
+	return len(cg.getNeighbours(agent))
+}
+
+func (cg *CommunicationGraph) GetWeightedOutDegree(agent uuid.UUID) int {
+	degree := 0
+	for id, weight := range cg.total[agent] {
+		if id != agent {
+			degree += weight
+		}
+	}
+	return degree
+}
+
+func (cg *CommunicationGraph) GetWeightedInDegree(agent uuid.UUID) int {
+	degree := 0
+	for id, recipients := range cg.total {
+		if id != agent {
+			degree += recipients[agent]
+		}
+	}
+	return degree
+}
+
+// Share of the pairs of neighbours that communicated with each other, directions are ignored. Zero for agents with
+// less than two neighbours.
+func (cg *CommunicationGraph) GetClusteringCoefficient(agent uuid.UUID) float64 {
+	neighbours := cg.getNeighbours(agent)
+	if len(neighbours) < 2 {
+		return 0
+	}
+	links := 0
+	for i, first := range neighbours {
+		for _, second := range neighbours[i+1:] {
+			if cg.total[first][second] > 0 || cg.total[second][first] > 0 {
+				links++
+			}
+		}
+	}
+	return float64(links) / float64(len(neighbours)*(len(neighbours)-1)/2)
+}
+
+func (cg *CommunicationGraph) GetAverageClusteringCoefficient() float64 {
+	if len(cg.nodes) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, id := range cg.nodes {
+		sum += cg.GetClusteringCoefficient(id)
+	}
+	return sum / float64(len(cg.nodes))
+}
+
+// Share of the edges whose reverse edge exists as well, zero for a graph without edges
+func (cg *CommunicationGraph) GetReciprocity() float64 {
+	edges, reciprocated := 0, 0
+	for sender, recipients := range cg.total {
+		for recipient := range recipients {
+			if sender == recipient {
+				continue
+			}
+			edges++
+			if cg.total[recipient][sender] > 0 {
+				reciprocated++
+			}
+		}
+	}
+	if edges == 0 {
+		return 0
+	}
+	return float64(reciprocated) / float64(edges)
+}
+
+// Agents that reach each other along the direction of the messages form a component (Tarjan). Components are sorted
+// by id and so is each component, agents without a path back to themselves form a component of their own.
+func (cg *CommunicationGraph) GetStronglyConnectedComponents() [][]uuid.UUID {
+	index := make(map[uuid.UUID]int)
+	lowLink := make(map[uuid.UUID]int)
+	isOnStack := make(map[uuid.UUID]bool)
+	stack := make([]uuid.UUID, 0)
+	components := make([][]uuid.UUID, 0)
+
+	var connect func(agent uuid.UUID)
+	connect = func(agent uuid.UUID) {
+		index[agent] = len(index)
+		lowLink[agent] = index[agent]
+		stack = append(stack, agent)
+		isOnStack[agent] = true
+		for _, id := range cg.getSuccessors(agent) {
+			if _, ok := index[id]; !ok {
+				connect(id)
+				lowLink[agent] = min(lowLink[agent], lowLink[id])
+			} else if isOnStack[id] {
+				lowLink[agent] = min(lowLink[agent], index[id])
+			}
+		}
+		if lowLink[agent] != index[agent] {
+			return
+		}
+		component := make([]uuid.UUID, 0)
+		for {
+			id := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			isOnStack[id] = false
+			component = append(component, id)
+			if id == agent {
+				break
+			}
+		}
+		slices.SortFunc(component, compareIDs)
+		components = append(components, component)
+	}
+
+	for _, id := range cg.nodes {
+		if _, ok := index[id]; !ok {
+			connect(id)
+		}
+	}
+	slices.SortFunc(components, func(a, b []uuid.UUID) int {
+		return compareIDs(a[0], b[0])
+	})
+	return components
+}
@@ -0,0 +1,225 @@
+package SOMACS
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+)
+
+type EnvironmentChange struct {
+	Key       string
+	OldValue  []byte
+	NewValue  []byte
+	IsDeleted bool
+	Iteration int // The iteration during which the change happened, starting at 1
+}
+
+// Variables as saved to memory at the end of an iteration, snapshot maps are shared and must not be modified
+type EnvironmentSnapshot struct {
+	Iteration int
+	Variables map[string][]byte
+}
+
+// Variables are copied on write: snapshots share the current map until the next change, so unchanged iterations
+// cost nothing and earlier snapshots never see later changes.
+type Environment struct {
+	variables       map[string][]byte
+	isShared        bool
+	history         []EnvironmentSnapshot
+	maxHistoryDepth int
+	iteration       *int
+	keyEvents       map[string]*Event[EnvironmentChange]
+	mutex           sync.RWMutex
+
+	// Package Exposure
+	OnChange Event[EnvironmentChange]
+}
+
+func (env *Environment) createEnvironment(variables map[string]ConfigBytes, maxHistoryDepth int, iteration *int) {
+	env.variables = make(map[string][]byte, len(variables))
+	for key, value := range variables {
+		env.variables[key] = value
+	}
+	env.history = make([]EnvironmentSnapshot, 0)
+	env.maxHistoryDepth = maxHistoryDepth
+	env.iteration = iteration
+	env.keyEvents = make(map[string]*Event[EnvironmentChange])
+}
+
+// Has to be called with the lock held
+func (env *Environment) prepareWrite() {
+	if env.isShared {
+		env.variables = maps.Clone(env.variables)
+		env.isShared = false
+	}
+}
+
+func (env *Environment) notify(change EnvironmentChange) {
+	env.OnChange.invoke(change)
+	env.mutex.RLock()
+	event, ok := env.keyEvents[change.Key]
+	env.mutex.RUnlock()
+	if ok {
+		event.invoke(change)
+	}
+}
+
+func (env *Environment) snapshot(iteration int) map[string][]byte {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	env.isShared = true
+	env.history = append(env.history, EnvironmentSnapshot{iteration, env.variables})
+	if env.maxHistoryDepth > 0 && len(env.history) > env.maxHistoryDepth {
+		env.history = env.history[1:]
+	}
+	return env.variables
+}
+
+// Replaces all variables without change events, history after the given iteration is dropped
+func (env *Environment) restore(variables map[string][]byte, iteration int) {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	if variables == nil {
+		variables = make(map[string][]byte)
+	}
+	env.variables = variables
+	env.isShared = true
+	env.history = slices.DeleteFunc(env.history, func(snapshot EnvironmentSnapshot) bool { return snapshot.Iteration > iteration })
+}
+
+func (env *Environment) getLastIteration() int {
+	env.mutex.RLock()
+	defer env.mutex.RUnlock()
+	if len(env.history) == 0 {
+		return *env.iteration
+	}
+	return env.history[len(env.history)-1].Iteration
+}
+
+func (env *Environment) setHistory(history []EnvironmentSnapshot) {
+	env.mutex.Lock()
+	env.history = slices.Clone(history)
+	env.mutex.Unlock()
+}
+
+// Exposed Functions
+
+func (env *Environment) Get(key string) ([]byte, bool) {
+	env.mutex.RLock()
+	defer env.mutex.RUnlock()
+	value, ok := env.variables[key]
+	return value, ok
+}
+
+func (env *Environment) Set(key string, value []byte) {
+	env.mutex.Lock()
+	env.prepareWrite()
+	oldValue := env.variables[key]
+	env.variables[key] = value
+	env.mutex.Unlock()
+	env.notify(EnvironmentChange{Key: key, OldValue: oldValue, NewValue: value, Iteration: *env.iteration + 1})
+}
+
+func (env *Environment) Delete(key string) {
+	env.mutex.Lock()
+	oldValue, ok := env.variables[key]
+	if !ok {
+		env.mutex.Unlock()
+		return
+	}
+	env.prepareWrite()
+	delete(env.variables, key)
+	env.mutex.Unlock()
+	env.notify(EnvironmentChange{Key: key, OldValue: oldValue, IsDeleted: true, Iteration: *env.iteration + 1})
+}
+
+func (env *Environment) GetKeys() []string {
+	env.mutex.RLock()
+	defer env.mutex.RUnlock()
+	keys := make([]string, 0, len(env.variables))
+	for key := range env.variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The returned map is shared with the environment and must not be modified
+func (env *Environment) GetAll() map[string][]byte {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	env.isShared = true
+	return env.variables
+}
+
+// Change events for a single variable
+func (env *Environment) OnKeyChange(key string) *Event[EnvironmentChange] {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	event, ok := env.keyEvents[key]
+	if !ok {
+		event = &Event[EnvironmentChange]{}
+		env.keyEvents[key] = event
+	}
+	return event
+}
+
+// Value as saved at the end of the given iteration (before OnUpdateEnvironment), iterations start at 1
+func (env *Environment) GetAt(iteration int, key string) ([]byte, bool) {
+	variables, ok := env.GetSnapshotAt(iteration)
+	if !ok {
+		return nil, false
+	}
+	value, ok := variables[key]
+	return value, ok
+}
+
+func (env *Environment) GetSnapshotAt(iteration int) (map[string][]byte, bool) {
+	env.mutex.RLock()
+	defer env.mutex.RUnlock()
+	i, found := slices.BinarySearchFunc(env.history, iteration, func(snapshot EnvironmentSnapshot, iteration int) int {
+		return snapshot.Iteration - iteration
+	})
+	if !found {
+		return nil, false
+	}
+	return env.history[i].Variables, true
+}
+
+func (env *Environment) GetHistory() []EnvironmentSnapshot {
+	env.mutex.RLock()
+	defer env.mutex.RUnlock()
+	return slices.Clone(env.history)
+}
+
+// Typed access (s. StateCodec.go)
+
+func GetVariableAs[T any](env *Environment, key string, codec StateCodec[T]) (T, bool, error) {
+	data, ok := env.Get(key)
+	if !ok {
+		var value T
+		return value, false, nil
+	}
+	value, err := codec.Decode(data)
+	return value, true, err
+}
+
+func GetVariableAtAs[T any](env *Environment, iteration int, key string, codec StateCodec[T]) (T, bool, error) {
+	data, ok := env.GetAt(iteration, key)
+	if !ok {
+		var value T
+		return value, false, nil
+	}
+	value, err := codec.Decode(data)
+	return value, true, err
+}
+
+func SetVariableTyped[T any](env *Environment, key string, codec StateCodec[T], value T) error {
+	data, err := codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	env.Set(key, data)
+	return nil
+}
@@ -7,16 +7,18 @@ import (
 
 type MessageStatistics struct {
 	communicationMap                 map[uuid.UUID]map[uuid.UUID][]Message //map[from][to][]messages
+	phaseMap                         map[uuid.UUID]map[uuid.UUID][]string  //map[from][to][]phases, aligned with the messages
 	hasSignaledMainMessagingComplete map[uuid.UUID]bool
 	mutex                            sync.Mutex
 }
 
 func (ms *MessageStatistics) createMessageStatistics() {
 	ms.communicationMap = make(map[uuid.UUID]map[uuid.UUID][]Message)
+	ms.phaseMap = make(map[uuid.UUID]map[uuid.UUID][]string)
 	ms.hasSignaledMainMessagingComplete = make(map[uuid.UUID]bool)
 }
 
-func (ms *MessageStatistics) recordMessage(msg Message) {
+func (ms *MessageStatistics) recordMessage(msg Message, phase string) {
 	ms.mutex.Lock()
 	comMap, ok := ms.communicationMap[msg.GetSender()]
 	if ok {
@@ -31,6 +33,12 @@ func (ms *MessageStatistics) recordMessage(msg Message) {
 		comMap[msg.Recipient] = append(comMap[msg.Recipient], msg)
 	}
 	ms.communicationMap[msg.GetSender()] = comMap
+	phaseMap, ok := ms.phaseMap[msg.GetSender()]
+	if !ok {
+		phaseMap = make(map[uuid.UUID][]string)
+		ms.phaseMap[msg.GetSender()] = phaseMap
+	}
+	phaseMap[msg.Recipient] = append(phaseMap[msg.Recipient], phase)
 	ms.mutex.Unlock()
 }
 
@@ -45,6 +53,9 @@ func (ms *MessageStatistics) clear() {
 	for id := range ms.communicationMap {
 		delete(ms.communicationMap, id)
 	}
+	for id := range ms.phaseMap {
+		delete(ms.phaseMap, id)
+	}
 	for id := range ms.hasSignaledMainMessagingComplete {
 		delete(ms.hasSignaledMainMessagingComplete, id)
 	}
@@ -1,14 +1,12 @@
 package SOMACS
 
 import (
-	"fmt"
-	"github.com/MattSScott/basePlatformSOMAS/v2/pkg/agent"
 	"github.com/google/uuid"
 	"slices"
 )
 
 type MetaAgent struct {
-	*agent.BaseAgent[IGenericAgent]
+	*BaseAgent
 
 	messageStatistics   MessageStatistics
 	subsumedModelAgents []*ModelAgent
@@ -30,19 +28,53 @@ type MetaAgent struct {
 	predict       func(*MessageStatistics, *MetaState) map[uuid.UUID][]byte
 	condition     MetaCondition
 	hasDissolved  bool
+	createdAt     int
+
+	dissolveReason DissolveReason
+	dissolveDetail string
+
+	dissolveMode          string
+	split                 func(*MetaAgent, []uuid.UUID) [][]uuid.UUID
+	pendingFailingMembers []uuid.UUID
 
 	evaluate func(*MetaAgent) float32
 
+	phaseHandlers phaseHandlers
+
 	serv *Server
 }
 
+type MetaAgentDefinition struct {
+	PartnerSearch func(*MessageStatistics, *MetaState) (map[uuid.UUID]map[uuid.UUID]bool, map[uuid.UUID][]uuid.UUID)
+	Predict       func(*MessageStatistics, *MetaState) map[uuid.UUID][]byte
+	Verify        func(*MessageStatistics, *MetaState, map[uuid.UUID][]byte) bool
+	Policy        VerificationPolicy // Has to hold as well as Verify, either may be nil (s. VerificationPolicy.go)
+	Evaluate      func(*MetaAgent) float32
+	Explain       func(*MetaAgent)
+	DissolveMode  string                                      // DISSOLVE_MODE_ALL if empty
+	Split         func(*MetaAgent, []uuid.UUID) [][]uuid.UUID // Groups the direct members given the failing ones, for DISSOLVE_MODE_SPLIT
+}
+
+func createMetaAgentFromDefinition(serv *Server, modelAgents []*ModelAgent, metaAgents []*MetaAgent, definition MetaAgentDefinition) IGenericAgent {
+	ma := createMetaAgent(serv, modelAgents, metaAgents,
+		definition.PartnerSearch, definition.Predict, definition.Verify, definition.Evaluate, definition.Explain).(*MetaAgent)
+	ma.condition.policy = definition.Policy
+	if definition.DissolveMode != "" {
+		ma.dissolveMode = definition.DissolveMode
+	}
+	if definition.Split != nil {
+		ma.split = definition.Split
+	}
+	return ma
+}
+
 func createMetaAgent(serv *Server, modelAgents []*ModelAgent, metaAgents []*MetaAgent,
 	partnerSearch func(*MessageStatistics, *MetaState) (map[uuid.UUID]map[uuid.UUID]bool, map[uuid.UUID][]uuid.UUID),
 	predict func(*MessageStatistics, *MetaState) map[uuid.UUID][]byte,
 	verify func(*MessageStatistics, *MetaState, map[uuid.UUID][]byte) bool,
 	evaluate func(*MetaAgent) float32,
 	explain func(*MetaAgent)) IGenericAgent {
-	ma := &MetaAgent{BaseAgent: agent.CreateBaseAgent(serv)}
+	ma := &MetaAgent{BaseAgent: createBaseAgent(serv, serv.createAgentID())}
 
 	ma.messageStatistics.createMessageStatistics()
 	ma.subsumedModelAgents = modelAgents
@@ -63,13 +95,7 @@ func createMetaAgent(serv *Server, modelAgents []*ModelAgent, metaAgents []*Meta
 		ag.subsumedBy = ma
 	}
 	ma.state.createMetaState(subsumedModelAgentStates, subsumedMetaAgentStates)
-	ma.externalModelAgents = make([]uuid.UUID, 0, len(serv.modelAgents))
-	for _, ag := range serv.modelAgents {
-		if ma.isSubsumedByMetaTree(ag) {
-			continue
-		}
-		ma.externalModelAgents = append(ma.externalModelAgents, ag)
-	}
+	ma.externalModelAgents = ma.findExternalModelAgents(serv)
 
 	ma.isSubsumed = false
 	ma.subsumedBy = nil
@@ -78,9 +104,12 @@ func createMetaAgent(serv *Server, modelAgents []*ModelAgent, metaAgents []*Meta
 	ma.predict = predict
 	ma.condition.createMetaCondition(verify, ma.state.GetModelStatesRecursive())
 	ma.hasDissolved = false
+	ma.createdAt = serv.iteration
+	ma.dissolveMode = DISSOLVE_MODE_ALL
+	ma.split = splitByVerification
 
 	ma.evaluate = func(ma *MetaAgent) float32 {
-		fmt.Printf("No Evaluation Method for Meta Agent provided.\n")
+		ma.serv.logger.Warn("no evaluation method for meta agent provided", "metaAgent", ma.GetID())
 		return 0
 	}
 
@@ -91,6 +120,7 @@ func createMetaAgent(serv *Server, modelAgents []*ModelAgent, metaAgents []*Meta
 		ma.SetExplanationFunc(explain)
 	}
 
+	ma.phaseHandlers = make(phaseHandlers)
 	ma.serv = serv
 
 	serv.metaAgents = append(serv.metaAgents, ma.GetID())
@@ -116,19 +146,34 @@ func (ma *MetaAgent) handleRecordableMessage(msg Message) {
 		ma.subsumedBy.handleRecordableMessage(msg)
 		return
 	}
-	ma.messageStatistics.recordMessage(msg)
+	ma.messageStatistics.recordMessage(msg, ma.serv.GetCurrentPhase())
 }
 
 // Code for (1) Communication Partner Validation
 
 func (ma *MetaAgent) setupCommunicationPartnerSearch() {
-	ma.expectedComValidRequests = len(ma.subsumedModelAgents) * len(ma.externalModelAgents)
+	if ma.serv.partnerScope.isRestricted() {
+		ma.expectedComValidRequests = 0
+		for _, ag := range ma.subsumedModelAgents {
+			ma.expectedComValidRequests += len(ag.findPartnerCandidates())
+		}
+	} else {
+		ma.expectedComValidRequests = len(ma.subsumedModelAgents) * len(ma.externalModelAgents)
+	}
 	ma.receivedComValidRequests = 0
 	ma.isProcessingPartnerValidation = false
 	ma.messageStatistics.clear()
 }
 
 func (ma *MetaAgent) handleCommunicationPartnerSearch() {
+	// Without requests to wait for the internal partners are processed right away
+	if !ma.isSubsumed && ma.expectedComValidRequests == 0 {
+		ma.isProcessingPartnerValidation = true
+		ma.messageStatistics.mutex.Lock()
+		ma.processCommunicationPartnerValidation()
+		ma.messageStatistics.mutex.Unlock()
+		return
+	}
 	ma.SignalMessagingComplete()
 }
 
@@ -141,7 +186,7 @@ func (ma *MetaAgent) handleValidationRequestMessage(msg Message) {
 		}
 		return
 	}
-	ma.messageStatistics.recordMessage(msg)
+	ma.messageStatistics.recordMessage(msg, ma.serv.GetCurrentPhase())
 	ma.receivedComValidRequests++
 	messageDropsExpected := 0 // Temporary solution for handling dropped traffic
 	if !ma.serv.areInternalMessagesSynchronous {
@@ -157,9 +202,9 @@ func (ma *MetaAgent) handleValidationRequestMessage(msg Message) {
 
 func (ma *MetaAgent) processCommunicationPartnerValidation() {
 	responses, internal := ma.callPartnerSearch()
-	for sender := range responses {
+	for _, sender := range sortedIDs(responses) {
 		senderAgent := ma.serv.modelAgentMap[sender]
-		for receiver := range responses[sender] {
+		for _, receiver := range sortedIDs(responses[sender]) {
 			if receiver == sender {
 				continue
 			}
@@ -171,7 +216,7 @@ func (ma *MetaAgent) processCommunicationPartnerValidation() {
 			}
 		}
 	}
-	for ag := range internal {
+	for _, ag := range sortedIDs(internal) {
 		subsumedAgent := ma.serv.modelAgentMap[ag]
 		for _, partner := range internal[ag] {
 			subsumedAgent.validComPartners = append(subsumedAgent.validComPartners, partner)
@@ -223,7 +268,8 @@ func (ma *MetaAgent) handleStateUpdatePhase() {
 }
 
 func (ma *MetaAgent) forwardStatesToModelAgents(states map[uuid.UUID][]byte) {
-	for id, state := range states {
+	for _, id := range sortedIDs(states) {
+		state := states[id]
 		msg := ma.CreateMessage()
 		msg.MessageType = MSGTYPE_META_UPDATE_MODEL
 		msg.Data = state
@@ -260,6 +306,46 @@ func (ma *MetaAgent) isSubsumedByMetaTree(ag uuid.UUID) bool {
 	return false
 }
 
+func (ma *MetaAgent) hasSubsumedExactly(modelAgents []uuid.UUID, metaAgents []uuid.UUID) bool {
+	if len(modelAgents) != len(ma.subsumedModelAgents) || len(metaAgents) != len(ma.subsumedMetaAgents) {
+		return false
+	}
+	for _, ag := range ma.subsumedModelAgents {
+		if !slices.Contains(modelAgents, ag.GetID()) {
+			return false
+		}
+	}
+	for _, ag := range ma.subsumedMetaAgents {
+		if !slices.Contains(metaAgents, ag.GetID()) {
+			return false
+		}
+	}
+	return true
+}
+
+// With a topology only graph neighbours of the subsumed agents are external, all other model agents otherwise
+func (ma *MetaAgent) findExternalModelAgents(serv *Server) []uuid.UUID {
+	if serv.partnerScope.topology == nil {
+		externalModelAgents := make([]uuid.UUID, 0, len(serv.modelAgents))
+		for _, ag := range serv.modelAgents {
+			if ma.isSubsumedByMetaTree(ag) {
+				continue
+			}
+			externalModelAgents = append(externalModelAgents, ag)
+		}
+		return externalModelAgents
+	}
+	neighbours := make(map[uuid.UUID]bool)
+	for id := range ma.state.GetModelStatesRecursive() {
+		for _, neighbour := range serv.partnerScope.topology.GetNeighbours(id) {
+			if !ma.isSubsumedByMetaTree(neighbour) {
+				neighbours[neighbour] = true
+			}
+		}
+	}
+	return sortedIDs(neighbours)
+}
+
 func (ma *MetaAgent) getExternalModelAgents() []uuid.UUID {
 	if ma.isSubsumed {
 		return ma.subsumedBy.getExternalModelAgents()
@@ -281,6 +367,19 @@ func (ma *MetaAgent) GetMessageStatistics() *MessageStatistics {
 	return &ma.messageStatistics
 }
 
+func (ma *MetaAgent) GetDefinition() MetaAgentDefinition {
+	return MetaAgentDefinition{
+		PartnerSearch: ma.partnerSearch,
+		Predict:       ma.predict,
+		Verify:        ma.condition.verifyFunc,
+		Policy:        ma.condition.policy,
+		Evaluate:      ma.evaluate,
+		Explain:       ma.condition.explain,
+		DissolveMode:  ma.dissolveMode,
+		Split:         ma.split,
+	}
+}
+
 func (ma *MetaAgent) GetSubsumedAgents() *[]uuid.UUID {
 	return &ma.subsumedAgents
 }
@@ -298,23 +397,20 @@ func (ma *MetaAgent) CreateMessage() *Message {
 }
 
 func (ma *MetaAgent) Verify() bool {
-	return ma.condition.verify(&ma.messageStatistics, &ma.state)
+	return ma.condition.verify(ma)
 }
 
 func (ma *MetaAgent) VerifyAndDissolve() {
-	if !ma.condition.verify(&ma.messageStatistics, &ma.state) {
-		ma.Dissolve()
-	}
+	ma.verifyAndDissolve(DISSOLVE_REASON_VERIFICATION_FAILED)
+}
+
+// Iterations since the meta agent was created
+func (ma *MetaAgent) GetAge() int {
+	return ma.serv.iteration - ma.createdAt
 }
 
 func (ma *MetaAgent) Dissolve() {
-	for _, id := range ma.subsumedAgents {
-		ma, ok := ma.serv.metaAgentMap[id]
-		if ok {
-			ma.VerifyAndDissolve()
-		}
-	}
-	ma.hasDissolved = true
+	ma.dissolve(DISSOLVE_REASON_MANUAL, "")
 }
 
 func (ma *MetaAgent) SetEvaluateFunc(evaluate func(*MetaAgent) float32) {
@@ -338,82 +434,114 @@ func (ma *MetaAgent) Explain() {
 // handling nil partner search is wip
 func (ma *MetaAgent) callPartnerSearch() (map[uuid.UUID]map[uuid.UUID]bool, map[uuid.UUID][]uuid.UUID) {
 	if ma.partnerSearch == nil {
-		responses := make(map[uuid.UUID]map[uuid.UUID]bool)
-		internal := make(map[uuid.UUID][]uuid.UUID)
-		for _, ag := range ma.subsumedMetaAgents {
-			r, i := ag.callPartnerSearch()
-			for subsumedAgent := range r {
-				responses[subsumedAgent] = r[subsumedAgent]
-				_, ok := internal[subsumedAgent]
-				if !ok {
-					internal[subsumedAgent] = i[subsumedAgent]
-				} else {
-					for _, partner := range i[subsumedAgent] {
-						internal[subsumedAgent] = append(internal[subsumedAgent], partner)
-					}
-				}
+		return ma.serv.searchPartnersOfMembers(&ma.messageStatistics, ma.subsumedModelAgents, ma.subsumedMetaAgents)
+	}
+	return ma.partnerSearch(&ma.messageStatistics, &ma.state)
+}
+
+// Fallback for meta agents without a partner search, the members validate the requests themselves
+func (serv *Server) searchPartnersOfMembers(messageStatistics *MessageStatistics, modelAgents []*ModelAgent, metaAgents []*MetaAgent) (map[uuid.UUID]map[uuid.UUID]bool, map[uuid.UUID][]uuid.UUID) {
+	responses := make(map[uuid.UUID]map[uuid.UUID]bool)
+	internal := make(map[uuid.UUID][]uuid.UUID)
+	for _, ag := range metaAgents {
+		r, i := ag.callPartnerSearch()
+		for subsumedAgent := range r {
+			responses[subsumedAgent] = r[subsumedAgent]
+			_, ok := internal[subsumedAgent]
+			if !ok {
 				internal[subsumedAgent] = i[subsumedAgent]
+			} else {
+				for _, partner := range i[subsumedAgent] {
+					internal[subsumedAgent] = append(internal[subsumedAgent], partner)
+				}
 			}
+			internal[subsumedAgent] = i[subsumedAgent]
 		}
-		for _, ag := range ma.subsumedModelAgents {
-			responses[ag.GetID()] = make(map[uuid.UUID]bool)
-			_, ok := internal[ag.GetID()]
-			if !ok {
-				internal[ag.GetID()] = make([]uuid.UUID, 0)
-			}
-			receivedMsgs, _ := ma.messageStatistics.GetAllMessagesToAgent(ag.GetID())
-			for _, msg := range receivedMsgs {
-				responses[ag.GetID()][msg.GetSender()] = ag.validationFunc(msg)
+	}
+	for _, ag := range modelAgents {
+		responses[ag.GetID()] = make(map[uuid.UUID]bool)
+		_, ok := internal[ag.GetID()]
+		if !ok {
+			internal[ag.GetID()] = make([]uuid.UUID, 0)
+		}
+		receivedMsgs, _ := messageStatistics.GetAllMessagesToAgent(ag.GetID())
+		for _, msg := range receivedMsgs {
+			responses[ag.GetID()][msg.GetSender()] = ag.validationFunc(msg)
+		}
+		for _, ag2 := range modelAgents {
+			if ag.GetID() == ag2.GetID() || !serv.partnerScope.allows(ag.GetID(), ag2.GetID()) {
+				continue
 			}
-			for _, ag2 := range ma.subsumedModelAgents {
-				if ag.GetID() == ag2.GetID() {
-					continue
-				}
-				val := ag2.validationFunc(*ag.createValidationRequestMessage())
-				if val {
-					internal[ag.GetID()] = append(internal[ag.GetID()], ag2.GetID())
-				}
+			val := ag2.validationFunc(*ag.createValidationRequestMessage())
+			if val {
+				internal[ag.GetID()] = append(internal[ag.GetID()], ag2.GetID())
 			}
 		}
-		for _, metaAgent1 := range ma.subsumedMetaAgents {
-			modelAgents1 := metaAgent1.state.GetModelStatesRecursive()
-			for _, metaAgent2 := range ma.subsumedMetaAgents {
-				if metaAgent1.GetID() == metaAgent2.GetID() {
-					continue
+	}
+	for _, metaAgent1 := range metaAgents {
+		modelAgents1 := metaAgent1.state.GetModelStatesRecursive()
+		for _, metaAgent2 := range metaAgents {
+			if metaAgent1.GetID() == metaAgent2.GetID() {
+				continue
+			}
+			modelAgents2 := metaAgent2.state.GetModelStatesRecursive()
+			for ag1 := range modelAgents1 {
+				_, ok := internal[ag1]
+				if !ok {
+					internal[ag1] = make([]uuid.UUID, 0)
 				}
-				modelAgents2 := metaAgent2.state.GetModelStatesRecursive()
-				for ag1 := range modelAgents1 {
-					_, ok := internal[ag1]
-					if !ok {
-						internal[ag1] = make([]uuid.UUID, 0)
+				for ag2 := range modelAgents2 {
+					if !serv.partnerScope.allows(ag1, ag2) {
+						continue
 					}
-					for ag2 := range modelAgents2 {
-						val := ma.serv.modelAgentMap[ag2].validationFunc(*ma.serv.modelAgentMap[ag1].createValidationRequestMessage())
-						if val {
-							internal[ag1] = append(internal[ag1], ag2)
-						}
+					val := serv.modelAgentMap[ag2].validationFunc(*serv.modelAgentMap[ag1].createValidationRequestMessage())
+					if val {
+						internal[ag1] = append(internal[ag1], ag2)
 					}
 				}
 			}
 		}
-		return responses, internal
 	}
-	return ma.partnerSearch(&ma.messageStatistics, &ma.state)
+	return responses, internal
 }
 
 // handling nil predict is wip
 func (ma *MetaAgent) callPredict() map[uuid.UUID][]byte {
 	if ma.predict == nil {
-		predictions := make(map[uuid.UUID][]byte)
-		for _, ag := range ma.subsumedMetaAgents {
-			p := ag.callPredict()
-			for subsumedAgent := range p {
-				predictions[subsumedAgent] = p[subsumedAgent]
-			}
-		}
-		for _, ag := range ma.subsumedModelAgents {
-			predictions[ag.GetID()] = ag.stateUpdateFunc()
-		}
+		return predictMembers(ma.subsumedModelAgents, ma.subsumedMetaAgents)
 	}
 	return ma.predict(&ma.messageStatistics, &ma.state)
 }
+
+// Fallback for meta agents without a predict, the members update their states themselves
+func predictMembers(modelAgents []*ModelAgent, metaAgents []*MetaAgent) map[uuid.UUID][]byte {
+	predictions := make(map[uuid.UUID][]byte)
+	for _, ag := range metaAgents {
+		p := ag.callPredict()
+		for subsumedAgent := range p {
+			predictions[subsumedAgent] = p[subsumedAgent]
+		}
+	}
+	for _, ag := range modelAgents {
+		predictions[ag.GetID()] = ag.stateUpdateFunc()
+	}
+	return predictions
+}
+
+// Code for custom phases
+
+func (ma *MetaAgent) setupPhase(phase string) {
+	if !ma.isSubsumed {
+		ma.phaseHandlers.setup(phase)
+	}
+}
+
+func (ma *MetaAgent) handlePhase(phase string) {
+	if ma.isSubsumed || ma.phaseHandlers.handle(phase) {
+		ma.SignalMessagingComplete()
+	}
+}
+
+func (ma *MetaAgent) SetPhaseHandler(phase string, handler PhaseHandler) {
+	ma.phaseHandlers[phase] = handler
+}
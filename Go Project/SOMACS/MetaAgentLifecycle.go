@@ -0,0 +1,100 @@
+package SOMACS
+
+import (
+	"github.com/google/uuid"
+	"slices"
+	"strings"
+)
+
+// Why a meta agent dissolved, recorded in the trace next to the dissolved meta agents
+type DissolveReason string
+
+const DISSOLVE_REASON_VERIFICATION_FAILED DissolveReason = "VerificationFailed"
+const DISSOLVE_REASON_PARENT_DISSOLVED DissolveReason = "ParentDissolved" // Failed verification once its parent dissolved
+const DISSOLVE_REASON_MANUAL DissolveReason = "Manual"
+const DISSOLVE_REASON_MEMBER_REMOVED DissolveReason = "MemberRemoved"
+const DISSOLVE_REASON_SPLIT DissolveReason = "Split"
+const DISSOLVE_REASON_MERGED DissolveReason = "Merged"
+
+// Passed to the meta agent events of the server. Reason and Detail are only set once the meta agent dissolves, Detail
+// holds the failure reason of the verification policy if there is one.
+type MetaAgentEvent struct {
+	MetaAgent *MetaAgent
+	Iteration int // Starting at 1
+	Reason    DissolveReason
+	Detail    string
+	Members   []uuid.UUID // Only set for ejected members
+}
+
+func (ma *MetaAgent) createMetaAgentEvent() MetaAgentEvent {
+	return MetaAgentEvent{ma, ma.serv.iteration + 1, ma.dissolveReason, ma.dissolveDetail, nil}
+}
+
+// Meta agents below a dissolving one have to verify again, as they are no longer covered by it
+func (ma *MetaAgent) dissolve(reason DissolveReason, detail string) {
+	if ma.hasDissolved {
+		return
+	}
+	ma.dissolveReason = reason
+	ma.dissolveDetail = detail
+	ma.serv.OnMetaAgentDissolving.invoke(ma.createMetaAgentEvent())
+	ma.hasDissolved = true
+	for _, id := range ma.subsumedAgents {
+		child, ok := ma.serv.metaAgentMap[id]
+		if ok {
+			child.verifyAndDissolve(DISSOLVE_REASON_PARENT_DISSOLVED)
+		}
+	}
+}
+
+func (ma *MetaAgent) verifyAndDissolve(reason DissolveReason) {
+	if ma.condition.verify(ma) {
+		ma.serv.OnMetaAgentVerified.invoke(ma.createMetaAgentEvent())
+		return
+	}
+	ma.serv.logger.Info("meta agent failed verification", "iteration", ma.serv.iteration+1, "metaAgent", ma.GetID(),
+		"reason", ma.condition.failureReason)
+	if ma.schedulePartialDissolution() {
+		return
+	}
+	ma.dissolve(reason, ma.condition.failureReason)
+}
+
+// Identifies a group by the model agents it covers, independent of how meta agents nest within it
+func getGroupKey(modelAgents []uuid.UUID) string {
+	ids := make([]string, len(modelAgents))
+	for i, id := range modelAgents {
+		ids[i] = id.String()
+	}
+	slices.Sort(ids)
+	return strings.Join(ids, ",")
+}
+
+func parseGroupKey(key string) []uuid.UUID {
+	if key == "" {
+		return []uuid.UUID{}
+	}
+	ids := strings.Split(key, ",")
+	modelAgents := make([]uuid.UUID, len(ids))
+	for i, id := range ids {
+		modelAgents[i] = uuid.MustParse(id)
+	}
+	return modelAgents
+}
+
+// Exposed Functions
+
+// Empty until the meta agent dissolves
+func (ma *MetaAgent) GetDissolveReason() (DissolveReason, string) {
+	return ma.dissolveReason, ma.dissolveDetail
+}
+
+// Iterations since a meta agent covering exactly these model agents dissolved. Only groups within the longest
+// cooldown set on an observer are remembered.
+func (serv *Server) GetIterationsSinceDissolved(modelAgents []uuid.UUID) (int, bool) {
+	iteration, ok := serv.dissolvedGroups[getGroupKey(modelAgents)]
+	if !ok {
+		return 0, false
+	}
+	return serv.iteration - iteration, true
+}
@@ -0,0 +1,260 @@
+package SOMACS
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"maps"
+	"slices"
+)
+
+// Two meta agents with the same parent are replaced by one flat meta agent subsuming the members of both. Each part
+// keeps predicting and verifying its own members, so merging does not change what the meta agents compute.
+
+func (ms *MetaState) getSubState(members []uuid.UUID) *MetaState {
+	subState := &MetaState{make(map[uuid.UUID]*MetaState), make(map[uuid.UUID][]byte)}
+	for _, id := range members {
+		if state, ok := ms.ModelStates[id]; ok {
+			subState.ModelStates[id] = state
+		}
+		if state, ok := ms.ChildStates[id]; ok {
+			subState.ChildStates[id] = state
+		}
+	}
+	return subState
+}
+
+func getSubBaseState(baseState map[uuid.UUID][]byte, subState *MetaState) map[uuid.UUID][]byte {
+	subBaseState := make(map[uuid.UUID][]byte)
+	for id := range subState.GetModelStatesRecursive() {
+		if state, ok := baseState[id]; ok {
+			subBaseState[id] = state
+		}
+	}
+	return subBaseState
+}
+
+// Checks a policy of one part on the members of that part only
+type partPolicy struct {
+	policy  VerificationPolicy
+	members []uuid.UUID
+}
+
+func (pp partPolicy) Check(context *VerificationContext) (bool, string) {
+	result := pp.CheckMembers(context)
+	return result.Passed, result.Reason
+}
+
+func (pp partPolicy) CheckMembers(context *VerificationContext) VerificationResult {
+	partContext := *context
+	partContext.State = context.State.getSubState(pp.members)
+	partContext.BaseState = getSubBaseState(context.BaseState, partContext.State)
+	return checkMembers(pp.policy, &partContext)
+}
+
+func (pp partPolicy) forget(metaAgent uuid.UUID) {
+	forgetMetaAgent(pp.policy, metaAgent)
+}
+
+// Members of the merged meta agent within the sub state of a part, in id order
+func (serv *Server) getMembersOfState(state *MetaState) ([]*ModelAgent, []*MetaAgent) {
+	modelAgents := make([]*ModelAgent, 0, len(state.ModelStates))
+	for _, id := range sortedIDs(state.ModelStates) {
+		modelAgents = append(modelAgents, serv.modelAgentMap[id])
+	}
+	metaAgents := make([]*MetaAgent, 0, len(state.ChildStates))
+	for _, id := range sortedIDs(state.ChildStates) {
+		metaAgents = append(metaAgents, serv.metaAgentMap[id])
+	}
+	return modelAgents, metaAgents
+}
+
+type mergePart struct {
+	members    []uuid.UUID
+	definition MetaAgentDefinition
+}
+
+// Parts without a partner search or predict fall back to their members, like meta agents without them do
+func composeDefinitions(serv *Server, parts []mergePart) MetaAgentDefinition {
+	policies := make([]VerificationPolicy, 0, len(parts))
+	hasVerify := false
+	for _, part := range parts {
+		if part.definition.Policy != nil {
+			policies = append(policies, partPolicy{part.definition.Policy, part.members})
+		}
+		hasVerify = hasVerify || part.definition.Verify != nil
+	}
+	definition := MetaAgentDefinition{
+		PartnerSearch: func(messageStatistics *MessageStatistics, state *MetaState) (map[uuid.UUID]map[uuid.UUID]bool, map[uuid.UUID][]uuid.UUID) {
+			responses := make(map[uuid.UUID]map[uuid.UUID]bool)
+			internal := make(map[uuid.UUID][]uuid.UUID)
+			for _, part := range parts {
+				subState := state.getSubState(part.members)
+				var partResponses map[uuid.UUID]map[uuid.UUID]bool
+				var partInternal map[uuid.UUID][]uuid.UUID
+				if part.definition.PartnerSearch == nil {
+					modelAgents, metaAgents := serv.getMembersOfState(subState)
+					partResponses, partInternal = serv.searchPartnersOfMembers(messageStatistics, modelAgents, metaAgents)
+				} else {
+					partResponses, partInternal = part.definition.PartnerSearch(messageStatistics, subState)
+				}
+				maps.Copy(responses, partResponses)
+				maps.Copy(internal, partInternal)
+			}
+			return responses, internal
+		},
+		Predict: func(messageStatistics *MessageStatistics, state *MetaState) map[uuid.UUID][]byte {
+			predictions := make(map[uuid.UUID][]byte)
+			for _, part := range parts {
+				subState := state.getSubState(part.members)
+				if part.definition.Predict == nil {
+					maps.Copy(predictions, predictMembers(serv.getMembersOfState(subState)))
+				} else {
+					maps.Copy(predictions, part.definition.Predict(messageStatistics, subState))
+				}
+			}
+			return predictions
+		},
+		Evaluate: func(ma *MetaAgent) float32 {
+			evaluation := float32(0)
+			for _, part := range parts {
+				evaluation += part.definition.Evaluate(ma)
+			}
+			return evaluation / float32(len(parts))
+		},
+		Explain: func(ma *MetaAgent) {
+			for _, part := range parts {
+				part.definition.Explain(ma)
+			}
+		},
+		DissolveMode: parts[0].definition.DissolveMode,
+		Split:        parts[0].definition.Split,
+	}
+	if hasVerify {
+		definition.Verify = func(messageStatistics *MessageStatistics, state *MetaState, baseState map[uuid.UUID][]byte) bool {
+			for _, part := range parts {
+				if part.definition.Verify == nil {
+					continue
+				}
+				subState := state.getSubState(part.members)
+				if !part.definition.Verify(messageStatistics, subState, getSubBaseState(baseState, subState)) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	if len(policies) > 0 {
+		definition.Policy = CreateAndPolicy(policies...)
+	}
+	return definition
+}
+
+func (serv *Server) validateMerge(first, second uuid.UUID) (*MetaAgent, *MetaAgent, error) {
+	firstAgent, ok := serv.metaAgentMap[first]
+	if !ok {
+		return nil, nil, fmt.Errorf("agent (%v) is not a meta agent", first)
+	}
+	secondAgent, ok := serv.metaAgentMap[second]
+	if !ok {
+		return nil, nil, fmt.Errorf("agent (%v) is not a meta agent", second)
+	}
+	if first == second {
+		return nil, nil, fmt.Errorf("meta agent (%v) cannot be merged with itself", first)
+	}
+	if firstAgent.subsumedBy != secondAgent.subsumedBy {
+		return nil, nil, fmt.Errorf("meta agents (%v) and (%v) are not on the same level", first, second)
+	}
+	return firstAgent, secondAgent, nil
+}
+
+// Merges queued during the iteration, skipped if one of the meta agents dissolved or was merged in the meantime
+func (serv *Server) applyPendingMerges() {
+	serv.pendingMutex.Lock()
+	merges := serv.pendingMerges
+	serv.pendingMerges = nil
+	serv.pendingMutex.Unlock()
+
+	for _, merge := range merges {
+		first, second, err := serv.validateMerge(merge[0], merge[1])
+		if err != nil {
+			serv.logger.Debug("meta agent merge skipped", "iteration", serv.iteration+1, "error", err)
+			continue
+		}
+		serv.mergeMetaAgents(first, second)
+	}
+}
+
+func (serv *Server) mergeMetaAgents(first, second *MetaAgent) *MetaAgent {
+	parts := []mergePart{
+		{slices.Clone(first.subsumedAgents), first.GetDefinition()},
+		{slices.Clone(second.subsumedAgents), second.GetDefinition()},
+	}
+	parent := first.subsumedBy
+	baseState := maps.Clone(first.condition.baseState)
+	maps.Copy(baseState, second.condition.baseState)
+
+	merged := createMetaAgentFromDefinition(serv,
+		append(append([]*ModelAgent{}, first.subsumedModelAgents...), second.subsumedModelAgents...),
+		append(append([]*MetaAgent{}, first.subsumedMetaAgents...), second.subsumedMetaAgents...),
+		composeDefinitions(serv, parts)).(*MetaAgent)
+	merged.condition.baseState = baseState
+	// The age policies check continues from the older part
+	merged.createdAt = min(first.createdAt, second.createdAt)
+	serv.metaHierarchy.merge(merged.GetID(), first.GetID(), second.GetID())
+	if parent != nil {
+		parent.replaceMembers(merged, first, second)
+	}
+	serv.AddAgent(merged)
+
+	for _, ma := range []*MetaAgent{first, second} {
+		ma.dissolveReason = DISSOLVE_REASON_MERGED
+		ma.dissolveDetail = fmt.Sprintf("merged into (%v)", merged.GetID())
+		ma.hasDissolved = true
+		serv.deleteMetaAgent(ma)
+		if serv.traceRecorder != nil {
+			serv.traceRecorder.recordDissolveReason(ma.GetID(), ma.dissolveReason)
+		}
+		serv.OnMetaAgentDissolved.invoke(ma.createMetaAgentEvent())
+	}
+	serv.logger.Debug("meta agents merged", "iteration", serv.iteration+1, "metaAgent", merged.GetID(),
+		"first", first.GetID(), "second", second.GetID())
+	serv.OnMetaAgentCreated.invoke(merged.createMetaAgentEvent())
+	return merged
+}
+
+// The merged meta agent takes the place of the two it replaces below the parent
+func (ma *MetaAgent) replaceMembers(merged, first, second *MetaAgent) {
+	metaAgents := make([]*MetaAgent, 0, len(ma.subsumedMetaAgents)-1)
+	for _, child := range ma.subsumedMetaAgents {
+		if child != first && child != second {
+			metaAgents = append(metaAgents, child)
+		}
+	}
+	ma.subsumedMetaAgents = append(metaAgents, merged)
+	agents := make([]uuid.UUID, 0, len(ma.subsumedAgents)-1)
+	for _, id := range ma.subsumedAgents {
+		if id != first.GetID() && id != second.GetID() {
+			agents = append(agents, id)
+		}
+	}
+	ma.subsumedAgents = append(agents, merged.GetID())
+	delete(ma.state.ChildStates, first.GetID())
+	delete(ma.state.ChildStates, second.GetID())
+	ma.state.ChildStates[merged.GetID()] = &merged.state
+	merged.isSubsumed = true
+	merged.subsumedBy = ma
+}
+
+// Exposed Functions
+
+// The meta agents are merged at the next cleanup turn, after dissolutions. Both have to be top level meta agents or
+// subsumed by the same meta agent.
+func (serv *Server) MergeMetaAgents(first, second uuid.UUID) error {
+	if _, _, err := serv.validateMerge(first, second); err != nil {
+		return err
+	}
+	serv.pendingMutex.Lock()
+	serv.pendingMerges = append(serv.pendingMerges, [2]uuid.UUID{first, second})
+	serv.pendingMutex.Unlock()
+	return nil
+}
@@ -1,29 +1,50 @@
 package SOMACS
 
 import (
-	"fmt"
 	"github.com/google/uuid"
 )
 
 type MetaCondition struct {
-	verifyFunc func(*MessageStatistics, *MetaState, map[uuid.UUID][]byte) bool
-	baseState  map[uuid.UUID][]byte
-	explain    func(*MetaAgent)
+	verifyFunc     func(*MessageStatistics, *MetaState, map[uuid.UUID][]byte) bool
+	policy         VerificationPolicy
+	baseState      map[uuid.UUID][]byte
+	failureReason  string
+	failingMembers []uuid.UUID
+	explain        func(*MetaAgent)
 }
 
 func (mc *MetaCondition) createMetaCondition(verify func(*MessageStatistics, *MetaState, map[uuid.UUID][]byte) bool, baseState map[uuid.UUID][]byte) {
 	mc.verifyFunc = verify
 	mc.baseState = baseState
-	mc.explain = func(*MetaAgent) {
-		fmt.Printf("No Explanation for MetaCondition provided.\n")
+	mc.explain = func(ma *MetaAgent) {
+		ma.serv.logger.Warn("no explanation for meta condition provided", "metaAgent", ma.GetID())
 	}
 }
 
-func (mc *MetaCondition) verify(messageStatistics *MessageStatistics, currentState *MetaState) bool {
-	if mc.verifyFunc == nil {
+// Both the verify function and the policy have to hold if set
+func (mc *MetaCondition) verify(ma *MetaAgent) bool {
+	mc.failureReason = ""
+	mc.failingMembers = nil
+	if mc.verifyFunc != nil && !mc.verifyFunc(&ma.messageStatistics, &ma.state, mc.baseState) {
+		mc.failureReason = "verify function failed"
+		return false
+	}
+	if mc.policy == nil {
 		return true
 	}
-	return mc.verifyFunc(messageStatistics, currentState, mc.baseState)
+	result := checkMembers(mc.policy, &VerificationContext{
+		MetaAgent:         ma,
+		MessageStatistics: &ma.messageStatistics,
+		State:             &ma.state,
+		BaseState:         mc.baseState,
+		Age:               ma.GetAge(),
+		Environment:       &ma.serv.environment,
+	})
+	if !result.Passed {
+		mc.failureReason = result.Reason
+		mc.failingMembers = result.FailingMembers
+	}
+	return result.Passed
 }
 
 // Exposed functions
@@ -31,3 +52,21 @@ func (mc *MetaCondition) verify(messageStatistics *MessageStatistics, currentSta
 func (mc *MetaCondition) GetBaseState() map[uuid.UUID][]byte {
 	return mc.baseState
 }
+
+func (mc *MetaCondition) SetPolicy(policy VerificationPolicy) {
+	mc.policy = policy
+}
+
+func (mc *MetaCondition) GetPolicy() VerificationPolicy {
+	return mc.policy
+}
+
+// Why the last verification failed, empty if it passed
+func (mc *MetaCondition) GetFailureReason() string {
+	return mc.failureReason
+}
+
+// Model agents the policy blamed for the last failed verification, empty if it could not name any
+func (mc *MetaCondition) GetFailingMembers() []uuid.UUID {
+	return mc.failingMembers
+}
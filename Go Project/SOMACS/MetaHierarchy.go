@@ -15,6 +15,40 @@ type MetaHierarchyNode struct {
 	Parent   *MetaHierarchyNode
 }
 
+// Parent-free copy of a node and its children, used for serialisation
+type MetaHierarchySnapshot struct {
+	Id       uuid.UUID
+	Children []MetaHierarchySnapshot
+}
+
+// Nodes missing from idMap are skipped, their restored children take their place
+func (ms MetaHierarchySnapshot) restore(idMap map[uuid.UUID]uuid.UUID, parent *MetaHierarchyNode) []*MetaHierarchyNode {
+	id, ok := idMap[ms.Id]
+	if !ok {
+		nodes := make([]*MetaHierarchyNode, 0, len(ms.Children))
+		for _, child := range ms.Children {
+			nodes = append(nodes, child.restore(idMap, parent)...)
+		}
+		return nodes
+	}
+	node := &MetaHierarchyNode{id, make([]*MetaHierarchyNode, 0, len(ms.Children)), parent}
+	for _, child := range ms.Children {
+		node.Children = append(node.Children, child.restore(idMap, node)...)
+	}
+	return []*MetaHierarchyNode{node}
+}
+
+func (ms MetaHierarchySnapshot) remap(idMap map[uuid.UUID]uuid.UUID) MetaHierarchySnapshot {
+	remapped := MetaHierarchySnapshot{ms.Id, make([]MetaHierarchySnapshot, len(ms.Children))}
+	if id, ok := idMap[ms.Id]; ok {
+		remapped.Id = id
+	}
+	for i, child := range ms.Children {
+		remapped.Children[i] = child.remap(idMap)
+	}
+	return remapped
+}
+
 func (mh *MetaHierarchy) createMetaHierarchy(modelAgents []uuid.UUID) {
 	mh.RootNodes = make([]*MetaHierarchyNode, len(modelAgents))
 	for j, id := range modelAgents {
@@ -76,11 +110,83 @@ func (mh *MetaHierarchy) dissolve(metaAgent uuid.UUID) {
 	}
 }
 
+// Puts the merged node, which already holds the children of both nodes, in the place of the first one
+func (mh *MetaHierarchy) merge(merged, first, second uuid.UUID) {
+	node, ok := mh.GetNodeByID(merged)
+	firstNode, isFirstFound := mh.GetNodeByID(first)
+	if !ok || !isFirstFound {
+		return
+	}
+	parent := firstNode.Parent
+	for _, id := range []uuid.UUID{first, second} {
+		replaced, ok := mh.GetNodeByID(id)
+		if !ok {
+			continue
+		}
+		if replaced.Parent == nil {
+			mh.removeFromRootNodes(id)
+		} else {
+			replaced.Parent.removeFromChildren(replaced)
+		}
+	}
+	if parent != nil {
+		mh.removeFromRootNodes(merged)
+		node.Parent = parent
+		parent.Children = append(parent.Children, node)
+	}
+}
+
+// The node and its children become a root, used when a meta agent ejects a member
+func (mh *MetaHierarchy) release(agent uuid.UUID) {
+	node, ok := mh.GetNodeByID(agent)
+	if !ok || node.Parent == nil {
+		return
+	}
+	node.Parent.removeFromChildren(node)
+	node.Parent = nil
+	mh.RootNodes = append(mh.RootNodes, node)
+}
+
 func (mh *MetaHierarchy) addAgent(agent uuid.UUID) {
 	node := &MetaHierarchyNode{agent, make([]*MetaHierarchyNode, 0), nil}
 	mh.RootNodes = append(mh.RootNodes, node)
 }
 
+func (mh *MetaHierarchy) removeAgent(agent uuid.UUID) {
+	node, ok := mh.GetNodeByID(agent)
+	if !ok {
+		return
+	}
+	if node.Parent == nil {
+		mh.removeFromRootNodes(agent)
+	} else {
+		node.Parent.removeFromChildren(node)
+	}
+}
+
+func (mh *MetaHierarchy) snapshot() []MetaHierarchySnapshot {
+	nodes := make([]MetaHierarchySnapshot, len(mh.RootNodes))
+	for i, node := range mh.RootNodes {
+		nodes[i] = node.snapshot()
+	}
+	return nodes
+}
+
+func (mh *MetaHierarchy) restoreSnapshot(nodes []MetaHierarchySnapshot, idMap map[uuid.UUID]uuid.UUID) {
+	mh.RootNodes = make([]*MetaHierarchyNode, 0, len(nodes))
+	for _, node := range nodes {
+		mh.RootNodes = append(mh.RootNodes, node.restore(idMap, nil)...)
+	}
+}
+
+func (mn *MetaHierarchyNode) snapshot() MetaHierarchySnapshot {
+	children := make([]MetaHierarchySnapshot, len(mn.Children))
+	for i, child := range mn.Children {
+		children[i] = child.snapshot()
+	}
+	return MetaHierarchySnapshot{mn.Id, children}
+}
+
 func (mn *MetaHierarchyNode) returnChildNodeWithID(id uuid.UUID) (*MetaHierarchyNode, bool) {
 	if id == mn.Id {
 		return mn, true
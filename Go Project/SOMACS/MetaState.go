@@ -1,6 +1,9 @@
 package SOMACS
 
-import "github.com/google/uuid"
+import (
+	"github.com/google/uuid"
+	"maps"
+)
 
 type MetaState struct {
 	ChildStates map[uuid.UUID]*MetaState
@@ -25,6 +28,15 @@ func (ms *MetaState) applyStateChange(states map[uuid.UUID][]byte) {
 	}
 }
 
+// Copies the maps of the whole tree, the states themselves are replaced rather than modified and are shared
+func (ms *MetaState) clone() *MetaState {
+	clone := &MetaState{make(map[uuid.UUID]*MetaState, len(ms.ChildStates)), maps.Clone(ms.ModelStates)}
+	for id, st := range ms.ChildStates {
+		clone.ChildStates[id] = st.clone()
+	}
+	return clone
+}
+
 // Exposed Functions
 
 func (ms *MetaState) GetModelStatesRecursive() map[uuid.UUID][]byte {
@@ -1,19 +1,25 @@
 package SOMACS
 
 import (
-	"github.com/MattSScott/basePlatformSOMAS/v2/pkg/agent"
+	"fmt"
 	"github.com/MattSScott/basePlatformSOMAS/v2/pkg/message"
 	"github.com/google/uuid"
+	"math/rand"
+	"slices"
 )
 
 type ModelAgent struct {
-	*agent.BaseAgent[IGenericAgent]
+	*BaseAgent
 	modelAgents                    *[]uuid.UUID
 	observerAgents                 *[]uuid.UUID
-	environment                    *map[string][]byte
+	environment                    *Environment
+	partnerScope                   *partnerScope
 	areInternalMessagesSynchronous *bool
+	isDeterministic                *bool
+	isShadowModeEnabled            *bool
 
 	state []byte
+	rng   *rand.Rand
 
 	// For (1) Communication Partner Search
 	expectedComValidRequests  int
@@ -21,6 +27,7 @@ type ModelAgent struct {
 	expectedComValidResponses int
 	receivedComValidResponses int
 	validComPartners          []uuid.UUID
+	partnerCandidates         []uuid.UUID
 	validationFunc            func(Message) bool
 	validationRequestData     []byte
 
@@ -29,11 +36,16 @@ type ModelAgent struct {
 
 	// For (3) State Update
 	stateUpdateFunc func() []byte
+	shadowState     []byte
+	hasShadowState  bool
 
 	// For meta agent subsumption
 	isSubsumed bool
 	subsumedBy *MetaAgent
 
+	// For custom phases
+	phaseHandlers phaseHandlers
+
 	// Package Exposure
 	OnHandleMessage                   Event[Message]
 	OnSetupCommunicationPartnerSearch Event[*ModelAgent]
@@ -44,14 +56,33 @@ type ModelAgent struct {
 }
 
 func CreateModelAgentBase(serv *Server) *ModelAgent {
-	ma := &ModelAgent{BaseAgent: agent.CreateBaseAgent(serv)}
+	ma := &ModelAgent{BaseAgent: createBaseAgent(serv, serv.createAgentID())}
+	ma.setupModelAgent(serv)
+	return ma
+}
+
+// Creates a copy with the same id registered on serv. Only the id, state and validation request data are copied,
+// functions and event subscriptions usually capture the original agent and have to be set up again by Clone.
+func (ma *ModelAgent) CloneModelAgentBase(serv *Server) *ModelAgent {
+	clone := &ModelAgent{BaseAgent: createBaseAgent(serv, ma.GetID())}
+	clone.setupModelAgent(serv)
+	clone.state = ma.state
+	clone.validationRequestData = ma.validationRequestData
+	return clone
+}
+
+func (ma *ModelAgent) setupModelAgent(serv *Server) {
 	ma.modelAgents = &serv.modelAgents
 	ma.observerAgents = &serv.observerAgents
-	ma.environment = &serv.environmentVariables
+	ma.environment = &serv.environment
+	ma.partnerScope = &serv.partnerScope
 
 	ma.state = make([]byte, 0)
 
 	ma.areInternalMessagesSynchronous = &serv.areInternalMessagesSynchronous
+	ma.isDeterministic = &serv.isDeterministic
+	ma.isShadowModeEnabled = &serv.isShadowModeEnabled
+	ma.rng = serv.createAgentRand()
 	ma.validComPartners = make([]uuid.UUID, 0, len(*ma.modelAgents))
 	ma.validationFunc = func(Message) bool { return true }
 	ma.validationRequestData = make([]byte, 0)
@@ -63,9 +94,10 @@ func CreateModelAgentBase(serv *Server) *ModelAgent {
 	ma.isSubsumed = false
 	ma.subsumedBy = nil
 
+	ma.phaseHandlers = make(phaseHandlers)
+
 	serv.modelAgents = append(serv.modelAgents, ma.GetID())
 	serv.modelAgentMap[ma.GetID()] = ma
-	return ma
 }
 
 func createModelAgent(serv *Server) IGenericAgent {
@@ -99,7 +131,11 @@ func (ma *ModelAgent) handleMessage(msg Message) {
 
 func (ma *ModelAgent) setupCommunicationPartnerSearch() {
 	ma.OnSetupCommunicationPartnerSearch.invoke(ma)
-	if ma.isSubsumed {
+	if ma.partnerScope.isRestricted() {
+		ma.partnerCandidates = ma.findPartnerCandidates()
+		ma.expectedComValidRequests = len(ma.partnerCandidates)
+		ma.expectedComValidResponses = len(ma.partnerCandidates)
+	} else if ma.isSubsumed {
 		ma.expectedComValidRequests = len(ma.subsumedBy.getExternalModelAgents())
 		ma.expectedComValidResponses = len(ma.subsumedBy.getExternalModelAgents())
 	} else {
@@ -114,7 +150,22 @@ func (ma *ModelAgent) setupCommunicationPartnerSearch() {
 func (ma *ModelAgent) handleCommunicationPartnerSearch() {
 	msg := ma.createValidationRequestMessage()
 	msg.Data = ma.validationRequestData
+	if ma.partnerScope.isRestricted() {
+		if len(ma.partnerCandidates) == 0 {
+			ma.SignalMessagingComplete()
+		} else if *ma.areInternalMessagesSynchronous {
+			ma.BroadcastSynchronousMessageSilentlyToRecipients(msg, ma.partnerCandidates)
+		} else {
+			ma.BroadcastMessageSilentlyToRecipients(msg, ma.partnerCandidates)
+		}
+		return
+	}
 	if ma.isSubsumed {
+		// A meta agent tree covering every model agent leaves nobody to ask
+		if len(ma.subsumedBy.getExternalModelAgents()) == 0 {
+			ma.SignalMessagingComplete()
+			return
+		}
 		if *ma.areInternalMessagesSynchronous {
 			ma.BroadcastSynchronousMessageSilentlyToRecipients(msg, ma.subsumedBy.getExternalModelAgents())
 			return
@@ -129,6 +180,20 @@ func (ma *ModelAgent) handleCommunicationPartnerSearch() {
 	ma.BroadcastMessageSilently(msg)
 }
 
+// Neighbours in the space and/or topology, subsumed agents skip the agents of their own meta agent tree.
+// Agents that are not placed in the space or topology have no candidates.
+func (ma *ModelAgent) findPartnerCandidates() []uuid.UUID {
+	neighbours := ma.partnerScope.neighbours(ma.GetID())
+	if !ma.isSubsumed {
+		return neighbours
+	}
+	top := ma.subsumedBy
+	for top.isSubsumed {
+		top = top.subsumedBy
+	}
+	return slices.DeleteFunc(neighbours, top.isSubsumedByMetaTree)
+}
+
 func (ma *ModelAgent) createValidationRequestMessage() *Message {
 	msg := ma.CreateMessage()
 	msg.MessageType = MSGTYPE_COM_VALID_REQUEST
@@ -143,6 +208,7 @@ func (ma *ModelAgent) handleValidationRequestMessage(msg Message) {
 		} else {
 			ma.SendMessageSilently(&msg, ma.subsumedBy.GetID())
 		}
+		ma.checkCommunicationPartnerSearchEnd()
 		return
 	}
 	isValid := ma.validationFunc(msg)
@@ -206,8 +272,14 @@ func (ma *ModelAgent) setupStateUpdatePhase() {
 
 func (ma *ModelAgent) handleStateUpdatePhase() {
 	if ma.isSubsumed {
+		// Runs before meta agents predict since model agents are handled first
+		if *ma.isShadowModeEnabled {
+			ma.shadowState = ma.stateUpdateFunc()
+			ma.hasShadowState = true
+		}
 		return
 	}
+	ma.hasShadowState = false
 	ma.state = ma.stateUpdateFunc()
 	msg := ma.createStateUpdateMessage()
 	if *ma.areInternalMessagesSynchronous {
@@ -232,21 +304,30 @@ func (ma *ModelAgent) handleMetaUpdateMessage(msg Message) {
 
 // Model Agent Messaging Overwrites
 
-func (ma *ModelAgent) SendMessage(msg message.IMessage[IGenericAgent], recipient uuid.UUID) {
+// Asynchronous delivery order depends on goroutine scheduling, so deterministic servers deliver synchronously
+func (ma *ModelAgent) deliverMessage(msg message.IMessage[IGenericAgent], recipient uuid.UUID) {
+	if *ma.isDeterministic {
+		ma.BaseAgent.SendSynchronousMessage(msg, recipient)
+		return
+	}
 	ma.BaseAgent.SendMessage(msg, recipient)
+}
+
+func (ma *ModelAgent) SendMessage(msg message.IMessage[IGenericAgent], recipient uuid.UUID) {
+	ma.deliverMessage(msg, recipient)
 	for _, oa := range *ma.observerAgents {
-		ma.BaseAgent.SendMessage(msg, oa)
+		ma.deliverMessage(msg, oa)
 	}
 }
 
 func (ma *ModelAgent) SendMessageToObservers(msg message.IMessage[IGenericAgent]) {
 	for _, oa := range *ma.observerAgents {
-		ma.BaseAgent.SendMessage(msg, oa)
+		ma.deliverMessage(msg, oa)
 	}
 }
 
 func (ma *ModelAgent) SendMessageSilently(msg message.IMessage[IGenericAgent], recipient uuid.UUID) {
-	ma.BaseAgent.SendMessage(msg, recipient)
+	ma.deliverMessage(msg, recipient)
 }
 
 func (ma *ModelAgent) BroadcastMessageToRecipients(msg message.IMessage[IGenericAgent], recipients []uuid.UUID) {
@@ -269,7 +350,7 @@ func (ma *ModelAgent) BroadcastMessageSilently(msg message.IMessage[IGenericAgen
 		if recipient == msg.GetSender() {
 			continue
 		}
-		ma.BaseAgent.SendMessage(msg, recipient)
+		ma.deliverMessage(msg, recipient)
 	}
 }
 
@@ -277,11 +358,11 @@ func (ma *ModelAgent) BroadcastMessageSilentlyToRecipients(msg message.IMessage[
 	typedMsg, ok := msg.(*Message)
 	for _, recipient := range recipients {
 		if !ok {
-			ma.BaseAgent.SendMessage(msg, recipient)
+			ma.deliverMessage(msg, recipient)
 			continue
 		}
 		typedMsg.Recipient = recipient
-		ma.BaseAgent.SendMessage(typedMsg, recipient)
+		ma.deliverMessage(typedMsg, recipient)
 	}
 }
 
@@ -356,14 +437,46 @@ func (ma *ModelAgent) EndMainCommunicationPhase() {
 }
 
 func (ma *ModelAgent) GetEnvironmentVariable(key string) ([]byte, bool) {
-	ret, ok := (*ma.environment)[key]
-	return ret, ok
+	return ma.environment.Get(key)
+}
+
+func (ma *ModelAgent) GetEnvironment() *Environment {
+	return ma.environment
+}
+
+// The agents partner search contacts this iteration
+func (ma *ModelAgent) GetPartnerCandidates() []uuid.UUID {
+	if ma.partnerScope.isRestricted() {
+		return ma.findPartnerCandidates()
+	}
+	if ma.isSubsumed {
+		return ma.subsumedBy.getExternalModelAgents()
+	}
+	return slices.DeleteFunc(slices.Clone(*ma.modelAgents), func(id uuid.UUID) bool { return id == ma.GetID() })
+}
+
+func (ma *ModelAgent) SetPosition(position Position) error {
+	if ma.partnerScope.space == nil {
+		return fmt.Errorf("server has no space to place agent (%v) in", ma.GetID())
+	}
+	return ma.partnerScope.space.Place(ma.GetID(), position)
+}
+
+func (ma *ModelAgent) GetPosition() (Position, bool) {
+	if ma.partnerScope.space == nil {
+		return Position{}, false
+	}
+	return ma.partnerScope.space.GetPosition(ma.GetID())
 }
 
 func (ma *ModelAgent) GetState() []byte {
 	return ma.state
 }
 
+func (ma *ModelAgent) GetRand() *rand.Rand {
+	return ma.rng
+}
+
 func (ma *ModelAgent) GetValidCommunicationPartners() []uuid.UUID {
 	return ma.validComPartners
 }
@@ -387,3 +500,21 @@ func (ma *ModelAgent) SetValidationRequestData(validationRequestData []byte) {
 func (ma *ModelAgent) SetStateUpdateFunc(stateUpdateFunc func() []byte) {
 	ma.stateUpdateFunc = stateUpdateFunc
 }
+
+// Code for custom phases
+
+func (ma *ModelAgent) setupPhase(phase string) {
+	if !ma.isSubsumed {
+		ma.phaseHandlers.setup(phase)
+	}
+}
+
+func (ma *ModelAgent) handlePhase(phase string) {
+	if ma.isSubsumed || ma.phaseHandlers.handle(phase) {
+		ma.SignalMessagingComplete()
+	}
+}
+
+func (ma *ModelAgent) SetPhaseHandler(phase string, handler PhaseHandler) {
+	ma.phaseHandlers[phase] = handler
+}
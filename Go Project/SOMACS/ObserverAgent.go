@@ -1,19 +1,26 @@
 package SOMACS
 
 import (
-	"fmt"
-	"github.com/MattSScott/basePlatformSOMAS/v2/pkg/agent"
 	"github.com/google/uuid"
+	"maps"
+	"math/rand"
 	"slices"
 )
 
-type ObserverStatistics struct {
-	MessageStatistics MessageStatistics
-	StateStatistics   StateStatistics
+type scheduledMetaAgent struct {
+	modelAgents []*ModelAgent
+	metaAgents  []*MetaAgent
+	definition  MetaAgentDefinition
+}
+
+// Consecutive iterations a group was scheduled in, for the stability window
+type groupSighting struct {
+	lastIteration int
+	count         int
 }
 
 type ObserverAgent struct {
-	*agent.BaseAgent[IGenericAgent]
+	*BaseAgent
 	modelAgents *[]uuid.UUID
 	metaAgents  *[]uuid.UUID
 
@@ -23,6 +30,7 @@ type ObserverAgent struct {
 	observedMetaAgents  *[]uuid.UUID
 
 	statistics ObserverStatistics
+	rng        *rand.Rand
 
 	// For (2) Main Communication Phase
 	expectedComMainEnd int
@@ -33,14 +41,14 @@ type ObserverAgent struct {
 	receivedStateUpdate int
 
 	// For Meta Agent Creation
-	serv                              *Server
-	scheduledMetaAgentModelAgents     [][]*ModelAgent
-	scheduledMetaAgentMetaAgents      [][]*MetaAgent
-	schedulesMetaAgentPartnerSearches []func(*MessageStatistics, *MetaState) (map[uuid.UUID]map[uuid.UUID]bool, map[uuid.UUID][]uuid.UUID)
-	scheduledMetaAgentPredicts        []func(*MessageStatistics, *MetaState) map[uuid.UUID][]byte
-	scheduledMetaAgentVerifies        []func(*MessageStatistics, *MetaState, map[uuid.UUID][]byte) bool
-	scheduledMetaAgentEvaluates       []func(*MetaAgent) float32
-	scheduledMetaAgentExplains        []func(*MetaAgent)
+	serv                *Server
+	scheduledMetaAgents []scheduledMetaAgent
+	cooldown            int
+	stabilityWindow     int
+	groupSightings      map[string]groupSighting
+
+	// For custom phases
+	phaseHandlers phaseHandlers
 
 	// Package Exposure
 	OnHandleMessage                   Event[Message]
@@ -54,7 +62,30 @@ type ObserverAgent struct {
 }
 
 func CreateObserverAgentBase(serv *Server) *ObserverAgent {
-	oa := &ObserverAgent{BaseAgent: agent.CreateBaseAgent(serv)}
+	oa := &ObserverAgent{BaseAgent: createBaseAgent(serv, serv.createAgentID())}
+	oa.setupObserverAgent(serv)
+	return oa
+}
+
+// Creates a copy with the same id and observed agents registered on serv. The observation strategy is reset to the
+// default and event subscriptions are not copied, Clone has to set them up again.
+func (oa *ObserverAgent) CloneObserverAgentBase(serv *Server) *ObserverAgent {
+	clone := &ObserverAgent{BaseAgent: createBaseAgent(serv, oa.GetID())}
+	clone.setupObserverAgent(serv)
+	observedModelAgents := slices.Clone(*oa.observedModelAgents)
+	clone.observedModelAgents = &observedModelAgents
+	observedMetaAgents := slices.Clone(*oa.observedMetaAgents)
+	clone.observedMetaAgents = &observedMetaAgents
+	clone.SetMetaAgentCooldown(oa.cooldown)
+	clone.stabilityWindow = oa.stabilityWindow
+	clone.groupSightings = maps.Clone(oa.groupSightings)
+	clone.statistics.window = oa.statistics.window
+	clone.statistics.history = slices.Clone(oa.statistics.history)
+	clone.statistics.StateStatistics.copySeries(&oa.statistics.StateStatistics)
+	return clone
+}
+
+func (oa *ObserverAgent) setupObserverAgent(serv *Server) {
 	oa.modelAgents = &serv.modelAgents
 	oa.metaAgents = &serv.metaAgents
 
@@ -66,18 +97,17 @@ func CreateObserverAgentBase(serv *Server) *ObserverAgent {
 
 	oa.statistics.MessageStatistics.createMessageStatistics()
 	oa.statistics.StateStatistics.createStateStatistics()
+	oa.rng = serv.createAgentRand()
 
 	oa.serv = serv
-	oa.scheduledMetaAgentModelAgents = make([][]*ModelAgent, 0)
-	oa.schedulesMetaAgentPartnerSearches = make([]func(*MessageStatistics, *MetaState) (map[uuid.UUID]map[uuid.UUID]bool, map[uuid.UUID][]uuid.UUID), 0)
-	oa.scheduledMetaAgentPredicts = make([]func(*MessageStatistics, *MetaState) map[uuid.UUID][]byte, 0)
-	oa.scheduledMetaAgentVerifies = make([]func(*MessageStatistics, *MetaState, map[uuid.UUID][]byte) bool, 0)
-	oa.scheduledMetaAgentEvaluates = make([]func(*MetaAgent) float32, 0)
-	oa.scheduledMetaAgentExplains = make([]func(*MetaAgent), 0)
+	oa.scheduledMetaAgents = make([]scheduledMetaAgent, 0)
+	oa.stabilityWindow = 1
+	oa.groupSightings = make(map[string]groupSighting)
+
+	oa.phaseHandlers = make(phaseHandlers)
 
 	serv.observerAgents = append(serv.observerAgents, oa.GetID())
 	serv.observerAgentMap[oa.GetID()] = oa
-	return oa
 }
 
 func createObserverAgent(serv *Server) IGenericAgent {
@@ -86,7 +116,7 @@ func createObserverAgent(serv *Server) IGenericAgent {
 
 func (oa *ObserverAgent) handleMessage(msg Message) {
 	if slices.Contains(*oa.observedModelAgents, msg.Recipient) || slices.Contains(*oa.observedModelAgents, msg.GetSender()) {
-		oa.statistics.MessageStatistics.recordMessage(msg)
+		oa.statistics.MessageStatistics.recordMessage(msg, oa.serv.GetCurrentPhase())
 	}
 	if !slices.Contains(*oa.observedModelAgents, msg.GetSender()) && !slices.Contains(*oa.observedMetaAgents, msg.GetSender()) {
 		return
@@ -139,10 +169,10 @@ func (oa *ObserverAgent) setupMainCommunicationPhase() {
 	oa.observedMetaAgents = observedMetaAgents
 
 	if len(*oa.observedModelAgents) > 0 {
-		fmt.Printf("Observer agent (%v) observes (%v) model agents\n", oa.GetID(), len(*oa.observedModelAgents))
+		oa.serv.logger.Debug("observing model agents", "iteration", oa.serv.iteration+1, "agent", oa.GetID(), "count", len(*oa.observedModelAgents))
 	}
 	if len(*oa.observedMetaAgents) > 0 {
-		fmt.Printf("Observer agent (%v) observes (%v) meta agents\n", oa.GetID(), len(*oa.observedMetaAgents))
+		oa.serv.logger.Debug("observing meta agents", "iteration", oa.serv.iteration+1, "agent", oa.GetID(), "count", len(*oa.observedMetaAgents))
 	}
 
 	oa.expectedComMainEnd = len(*oa.observedModelAgents)
@@ -189,6 +219,7 @@ func (oa *ObserverAgent) handleMetaStateUpdateMessage(msg Message) {
 
 func (oa *ObserverAgent) checkAllStateUpdatesReceived() {
 	if oa.receivedStateUpdate == oa.expectedStateUpdate {
+		oa.statistics.archive(oa.serv.iteration + 1)
 		oa.OnAfterAllStateUpdatesReceived.invoke(&oa.statistics)
 		oa.createMetaAgents()
 		oa.SignalMessagingComplete()
@@ -196,12 +227,25 @@ func (oa *ObserverAgent) checkAllStateUpdatesReceived() {
 }
 
 func (oa *ObserverAgent) createMetaAgents() {
-	for i := range oa.scheduledMetaAgentModelAgents {
-		oa.serv.AddAgent(createMetaAgent(oa.serv,
-			oa.scheduledMetaAgentModelAgents[i], oa.scheduledMetaAgentMetaAgents[i],
-			oa.schedulesMetaAgentPartnerSearches[i], oa.scheduledMetaAgentPredicts[i], oa.scheduledMetaAgentVerifies[i],
-			oa.scheduledMetaAgentEvaluates[i], oa.scheduledMetaAgentExplains[i]))
-		for _, ag := range oa.scheduledMetaAgentModelAgents[i] {
+	for _, scheduled := range oa.scheduledMetaAgents {
+		// Overlapping schedules would leave an agent subsumed by two meta agents
+		if oa.isAnyAgentSubsumed(scheduled.modelAgents, scheduled.metaAgents) {
+			oa.serv.logger.Warn("scheduled meta agent skipped, an agent is already subsumed", "iteration", oa.serv.iteration+1, "agent", oa.GetID())
+			continue
+		}
+		key := getGroupKey(scheduled.getModelAgentsRecursive())
+		if !oa.isGroupReady(key) {
+			oa.serv.logger.Debug("scheduled meta agent deferred", "iteration", oa.serv.iteration+1, "agent", oa.GetID(),
+				"sightings", oa.groupSightings[key].count)
+			continue
+		}
+		delete(oa.groupSightings, key)
+		ma := createMetaAgentFromDefinition(oa.serv, scheduled.modelAgents, scheduled.metaAgents, scheduled.definition).(*MetaAgent)
+		oa.serv.AddAgent(ma)
+		oa.serv.logger.Debug("meta agent created", "iteration", oa.serv.iteration+1, "agent", oa.GetID(), "metaAgent", ma.GetID(),
+			"modelAgents", len(scheduled.modelAgents), "metaAgents", len(scheduled.metaAgents))
+		oa.serv.OnMetaAgentCreated.invoke(ma.createMetaAgentEvent())
+		for _, ag := range scheduled.modelAgents {
 			l := len(*oa.observedModelAgents)
 			for j := 1; j <= l; j++ {
 				if (*oa.observedModelAgents)[l-j] == ag.GetID() {
@@ -210,13 +254,54 @@ func (oa *ObserverAgent) createMetaAgents() {
 			}
 		}
 	}
-	oa.scheduledMetaAgentModelAgents = oa.scheduledMetaAgentModelAgents[:0]
-	oa.scheduledMetaAgentMetaAgents = oa.scheduledMetaAgentMetaAgents[:0]
-	oa.schedulesMetaAgentPartnerSearches = oa.schedulesMetaAgentPartnerSearches[:0]
-	oa.scheduledMetaAgentPredicts = oa.scheduledMetaAgentPredicts[:0]
-	oa.scheduledMetaAgentVerifies = oa.scheduledMetaAgentVerifies[:0]
-	oa.scheduledMetaAgentEvaluates = oa.scheduledMetaAgentEvaluates[:0]
-	oa.scheduledMetaAgentExplains = oa.scheduledMetaAgentExplains[:0]
+	oa.scheduledMetaAgents = oa.scheduledMetaAgents[:0]
+	for key, sighting := range oa.groupSightings {
+		if sighting.lastIteration < oa.serv.iteration {
+			delete(oa.groupSightings, key)
+		}
+	}
+}
+
+// Groups have to be scheduled in stabilityWindow consecutive iterations and may not have dissolved within the cooldown
+func (oa *ObserverAgent) isGroupReady(key string) bool {
+	sighting, ok := oa.groupSightings[key]
+	switch {
+	case !ok || sighting.lastIteration < oa.serv.iteration-1:
+		sighting = groupSighting{oa.serv.iteration, 1}
+	case sighting.lastIteration == oa.serv.iteration-1:
+		sighting = groupSighting{oa.serv.iteration, sighting.count + 1}
+	}
+	oa.groupSightings[key] = sighting
+	if sighting.count < oa.stabilityWindow {
+		return false
+	}
+	dissolvedAt, ok := oa.serv.dissolvedGroups[key]
+	return !ok || oa.serv.iteration-dissolvedAt > oa.cooldown
+}
+
+func (scheduled *scheduledMetaAgent) getModelAgentsRecursive() []uuid.UUID {
+	modelAgents := make([]uuid.UUID, 0, len(scheduled.modelAgents))
+	for _, ag := range scheduled.modelAgents {
+		modelAgents = append(modelAgents, ag.GetID())
+	}
+	for _, ag := range scheduled.metaAgents {
+		modelAgents = append(modelAgents, ag.GetAllSubsumedModelAgentsRecursive()...)
+	}
+	return modelAgents
+}
+
+func (oa *ObserverAgent) isAnyAgentSubsumed(modelAgents []*ModelAgent, metaAgents []*MetaAgent) bool {
+	for _, ag := range modelAgents {
+		if ag.isSubsumed {
+			return true
+		}
+	}
+	for _, ag := range metaAgents {
+		if ag.isSubsumed {
+			return true
+		}
+	}
+	return false
 }
 
 // Exposed Functions
@@ -244,6 +329,10 @@ func (oa *ObserverAgent) GetObservedMetaAgents() *[]uuid.UUID {
 	return oa.observedMetaAgents
 }
 
+func (oa *ObserverAgent) GetRand() *rand.Rand {
+	return oa.rng
+}
+
 func (oa *ObserverAgent) GetServer() *Server {
 	return oa.serv
 }
@@ -258,15 +347,48 @@ func (oa *ObserverAgent) ScheduleMetaAgent(modelAgents []*ModelAgent, metaAgents
 	verify func(*MessageStatistics, *MetaState, map[uuid.UUID][]byte) bool,
 	evaluate func(*MetaAgent) float32,
 	explain func(*MetaAgent)) {
-	oa.scheduledMetaAgentModelAgents = append(oa.scheduledMetaAgentModelAgents, modelAgents)
-	oa.scheduledMetaAgentMetaAgents = append(oa.scheduledMetaAgentMetaAgents, metaAgents)
-	oa.schedulesMetaAgentPartnerSearches = append(oa.schedulesMetaAgentPartnerSearches, partnerSearch)
-	oa.scheduledMetaAgentPredicts = append(oa.scheduledMetaAgentPredicts, predictState)
-	oa.scheduledMetaAgentVerifies = append(oa.scheduledMetaAgentVerifies, verify)
-	oa.scheduledMetaAgentEvaluates = append(oa.scheduledMetaAgentEvaluates, evaluate)
-	oa.scheduledMetaAgentExplains = append(oa.scheduledMetaAgentExplains, explain)
+	oa.ScheduleMetaAgentDefinition(modelAgents, metaAgents, MetaAgentDefinition{
+		PartnerSearch: partnerSearch,
+		Predict:       predictState,
+		Verify:        verify,
+		Evaluate:      evaluate,
+		Explain:       explain,
+	})
+}
+
+// The meta agent is created once all state updates of this iteration were received
+func (oa *ObserverAgent) ScheduleMetaAgentDefinition(modelAgents []*ModelAgent, metaAgents []*MetaAgent, definition MetaAgentDefinition) {
+	oa.scheduledMetaAgents = append(oa.scheduledMetaAgents, scheduledMetaAgent{modelAgents, metaAgents, definition})
+}
+
+// Groups dissolved within the last iterations are not subsumed again, 0 disables the cooldown
+func (oa *ObserverAgent) SetMetaAgentCooldown(iterations int) {
+	oa.cooldown = iterations
+	oa.serv.maxMetaAgentCooldown = max(oa.serv.maxMetaAgentCooldown, iterations)
+}
+
+// Scheduled meta agents are only created once the same group was scheduled in that many consecutive iterations,
+// 1 creates them right away
+func (oa *ObserverAgent) SetMetaAgentStabilityWindow(iterations int) {
+	oa.stabilityWindow = max(iterations, 1)
 }
 
 func (oa *ObserverAgent) SetObservationStrategy(strategy func() (*[]uuid.UUID, *[]uuid.UUID)) {
 	oa.observationStrategy = strategy
 }
+
+// Code for custom phases
+
+func (oa *ObserverAgent) setupPhase(phase string) {
+	oa.phaseHandlers.setup(phase)
+}
+
+func (oa *ObserverAgent) handlePhase(phase string) {
+	if oa.phaseHandlers.handle(phase) {
+		oa.SignalMessagingComplete()
+	}
+}
+
+func (oa *ObserverAgent) SetPhaseHandler(phase string, handler PhaseHandler) {
+	oa.phaseHandlers[phase] = handler
+}
@@ -0,0 +1,147 @@
+package SOMACS
+
+import (
+	"github.com/google/uuid"
+	"maps"
+	"slices"
+)
+
+// The statistics of the current iteration, cleared by the observer as the iteration goes on. With a window set, a
+// copy of every iteration is kept once all state updates were received, so patterns only visible over several
+// iterations can be detected.
+type ObserverStatistics struct {
+	MessageStatistics MessageStatistics
+	StateStatistics   StateStatistics
+
+	window  int
+	history []*IterationStatistics // Oldest first
+}
+
+type IterationStatistics struct {
+	Iteration         int // Starting at 1
+	MessageStatistics *MessageStatistics
+	StateStatistics   *StateStatistics
+}
+
+func (ms *MessageStatistics) snapshot() *MessageStatistics {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	snapshot := &MessageStatistics{}
+	snapshot.createMessageStatistics()
+	for sender, recipients := range ms.communicationMap {
+		snapshot.communicationMap[sender] = make(map[uuid.UUID][]Message, len(recipients))
+		snapshot.phaseMap[sender] = make(map[uuid.UUID][]string, len(recipients))
+		for recipient, msgs := range recipients {
+			snapshot.communicationMap[sender][recipient] = slices.Clone(msgs)
+			snapshot.phaseMap[sender][recipient] = slices.Clone(ms.phaseMap[sender][recipient])
+		}
+	}
+	maps.Copy(snapshot.hasSignaledMainMessagingComplete, ms.hasSignaledMainMessagingComplete)
+	return snapshot
+}
+
+func (ss *StateStatistics) snapshot() *StateStatistics {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	snapshot := &StateStatistics{}
+	snapshot.createStateStatistics()
+	maps.Copy(snapshot.states, ss.states)
+	for id, state := range ss.metaStates {
+		snapshot.metaStates[id] = state.clone()
+	}
+	maps.Copy(snapshot.metaDissolved, ss.metaDissolved)
+	return snapshot
+}
+
+func (ost *ObserverStatistics) archive(iteration int) {
+	ost.StateStatistics.extendSeries(iteration)
+	if ost.window < 1 {
+		return
+	}
+	ost.history = append(ost.history, &IterationStatistics{iteration, ost.MessageStatistics.snapshot(), ost.StateStatistics.snapshot()})
+	if len(ost.history) > ost.window {
+		ost.history = slices.Delete(ost.history, 0, len(ost.history)-ost.window)
+	}
+}
+
+// The last iterations of the history, all of it for iterations below 1
+func (ost *ObserverStatistics) getRecent(iterations int) []*IterationStatistics {
+	if iterations < 1 || iterations >= len(ost.history) {
+		return ost.history
+	}
+	return ost.history[len(ost.history)-iterations:]
+}
+
+// Exposed Functions
+
+// Number of iterations kept in the history, 0 disables it. Shrinking the window drops the oldest iterations.
+func (ost *ObserverStatistics) SetWindow(iterations int) {
+	ost.window = max(iterations, 0)
+	if len(ost.history) > ost.window {
+		ost.history = slices.Delete(ost.history, 0, len(ost.history)-ost.window)
+	}
+}
+
+func (ost *ObserverStatistics) GetWindow() int {
+	return ost.window
+}
+
+// Oldest first, the last entry is the current iteration once all its state updates were received
+func (ost *ObserverStatistics) GetHistory() []*IterationStatistics {
+	return ost.history
+}
+
+func (ost *ObserverStatistics) GetIterationStatistics(iteration int) (*IterationStatistics, bool) {
+	for _, statistics := range ost.history {
+		if statistics.Iteration == iteration {
+			return statistics, true
+		}
+	}
+	return nil, false
+}
+
+// Aggregate queries over the last iterations of the history, all of it for iterations below 1
+
+func (ost *ObserverStatistics) GetMessagesFromTo(sender, recipient uuid.UUID, iterations int) []Message {
+	messages := make([]Message, 0)
+	for _, statistics := range ost.getRecent(iterations) {
+		msgs, _ := statistics.MessageStatistics.GetMessagesFromTo(sender, recipient)
+		messages = append(messages, msgs...)
+	}
+	return messages
+}
+
+// Messages in both directions
+func (ost *ObserverStatistics) GetMessageCountBetween(agent1, agent2 uuid.UUID, iterations int) int {
+	count := 0
+	for _, statistics := range ost.getRecent(iterations) {
+		msgs, _ := statistics.MessageStatistics.GetMessagesFromTo(agent1, agent2)
+		count += len(msgs)
+		if agent1 != agent2 {
+			msgs, _ = statistics.MessageStatistics.GetMessagesFromTo(agent2, agent1)
+			count += len(msgs)
+		}
+	}
+	return count
+}
+
+// Number of iterations in which the agents communicated in either direction
+func (ost *ObserverStatistics) CountIterationsCommunicated(agent1, agent2 uuid.UUID, iterations int) int {
+	count := 0
+	for _, statistics := range ost.getRecent(iterations) {
+		if statistics.MessageStatistics.HasCommunicatedWith(agent1, agent2) {
+			count++
+		}
+	}
+	return count
+}
+
+// Graph of the messages recorded in the given phases over the iterations, all phases if none are given
+func (ost *ObserverStatistics) GetCommunicationGraph(iterations int, phases ...string) *CommunicationGraph {
+	cg := createCommunicationGraph()
+	for _, statistics := range ost.getRecent(iterations) {
+		statistics.MessageStatistics.addToCommunicationGraph(cg, phases)
+	}
+	cg.addNodes()
+	return cg
+}
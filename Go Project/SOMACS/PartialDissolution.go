@@ -0,0 +1,134 @@
+package SOMACS
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"slices"
+)
+
+// What happens to a meta agent failing verification. Ejecting and splitting need a MemberVerificationPolicy naming
+// the failing members, the meta agent dissolves as a whole otherwise.
+const DISSOLVE_MODE_ALL = "all"
+const DISSOLVE_MODE_EJECT = "eject" // Failing members are released, the rest stays subsumed
+const DISSOLVE_MODE_SPLIT = "split" // The members are regrouped into new meta agents with the same definition
+
+// Default for MetaAgentDefinition.Split, the passing members are regrouped and the failing ones released
+func splitByVerification(ma *MetaAgent, failing []uuid.UUID) [][]uuid.UUID {
+	passing := slices.DeleteFunc(slices.Clone(ma.subsumedAgents), func(id uuid.UUID) bool { return slices.Contains(failing, id) })
+	return [][]uuid.UUID{passing}
+}
+
+// Failing model agents are mapped to the direct members subsuming them
+func (ma *MetaAgent) getMembersContaining(modelAgents []uuid.UUID) []uuid.UUID {
+	members := make([]uuid.UUID, 0, len(modelAgents))
+	for _, id := range ma.subsumedAgents {
+		child, isMetaAgent := ma.serv.metaAgentMap[id]
+		for _, ag := range modelAgents {
+			if id == ag || (isMetaAgent && child.isSubsumedByMetaTree(ag)) {
+				members = append(members, id)
+				break
+			}
+		}
+	}
+	return members
+}
+
+// Applied at the cleanup turn together with the dissolutions
+func (ma *MetaAgent) schedulePartialDissolution() bool {
+	if ma.dissolveMode == DISSOLVE_MODE_ALL || ma.hasDissolved || len(ma.condition.failingMembers) == 0 {
+		return false
+	}
+	failing := ma.getMembersContaining(ma.condition.failingMembers)
+	if len(failing) == 0 || (ma.dissolveMode == DISSOLVE_MODE_EJECT && len(ma.subsumedAgents)-len(failing) < 2) {
+		return false
+	}
+	ma.pendingFailingMembers = failing
+	return true
+}
+
+// Dissolved meta agents are gone by now, their children are top level again
+func (serv *Server) applyPartialDissolutions() {
+	for _, id := range slices.Clone(serv.metaAgents) {
+		ma := serv.metaAgentMap[id]
+		failing := ma.pendingFailingMembers
+		if len(failing) == 0 {
+			continue
+		}
+		ma.pendingFailingMembers = nil
+		if ma.dissolveMode == DISSOLVE_MODE_SPLIT {
+			serv.splitMetaAgent(ma, failing)
+		} else {
+			serv.ejectMembers(ma, failing)
+		}
+	}
+}
+
+// Ancestors cover the released model agent no longer either
+func (ma *MetaAgent) deleteFromBaseStates(modelAgent uuid.UUID) {
+	for ancestor := ma; ancestor != nil; ancestor = ancestor.subsumedBy {
+		delete(ancestor.condition.baseState, modelAgent)
+	}
+}
+
+func (serv *Server) ejectMembers(ma *MetaAgent, members []uuid.UUID) {
+	for _, id := range members {
+		ma.subsumedAgents = slices.DeleteFunc(ma.subsumedAgents, func(cmp uuid.UUID) bool { return cmp == id })
+		if ag, ok := serv.modelAgentMap[id]; ok {
+			ma.subsumedModelAgents = slices.DeleteFunc(ma.subsumedModelAgents, func(cmp *ModelAgent) bool { return cmp == ag })
+			delete(ma.state.ModelStates, id)
+			ma.deleteFromBaseStates(id)
+			ag.isSubsumed = false
+			ag.subsumedBy = nil
+		}
+		if child, ok := serv.metaAgentMap[id]; ok {
+			ma.subsumedMetaAgents = slices.DeleteFunc(ma.subsumedMetaAgents, func(cmp *MetaAgent) bool { return cmp == child })
+			delete(ma.state.ChildStates, id)
+			for ag := range child.state.GetModelStatesRecursive() {
+				ma.deleteFromBaseStates(ag)
+			}
+			child.isSubsumed = false
+			child.subsumedBy = nil
+			child.externalModelAgents = child.findExternalModelAgents(serv)
+		}
+		serv.metaHierarchy.release(id)
+	}
+	for ancestor := ma; ancestor != nil; ancestor = ancestor.subsumedBy {
+		ancestor.externalModelAgents = ancestor.findExternalModelAgents(serv)
+	}
+	serv.logger.Debug("meta agent ejected members", "iteration", serv.iteration+1, "metaAgent", ma.GetID(), "members", len(members))
+	event := ma.createMetaAgentEvent()
+	event.Members = members
+	serv.OnMetaAgentMembersEjected.invoke(event)
+}
+
+// The meta agent dissolves, groups of at least two members are subsumed again right away and members in no group
+// are released
+func (serv *Server) splitMetaAgent(ma *MetaAgent, failing []uuid.UUID) {
+	groups := ma.split(ma, failing)
+	definition := ma.GetDefinition()
+	ma.dissolveReason = DISSOLVE_REASON_SPLIT
+	ma.dissolveDetail = fmt.Sprintf("split into (%v) groups", len(groups))
+	serv.OnMetaAgentDissolving.invoke(ma.createMetaAgentEvent())
+	ma.hasDissolved = true
+	serv.removeDissolvedMetaAgent(ma)
+
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		modelAgents := make([]*ModelAgent, 0, len(group))
+		metaAgents := make([]*MetaAgent, 0)
+		for _, id := range group {
+			if ag, ok := serv.modelAgentMap[id]; ok {
+				modelAgents = append(modelAgents, ag)
+			} else if child, ok := serv.metaAgentMap[id]; ok {
+				metaAgents = append(metaAgents, child)
+			}
+		}
+		created := createMetaAgentFromDefinition(serv, modelAgents, metaAgents, definition).(*MetaAgent)
+		serv.AddAgent(created)
+		serv.logger.Debug("meta agent created by split", "iteration", serv.iteration+1, "metaAgent", created.GetID(),
+			"splitFrom", ma.GetID(), "members", len(group))
+		serv.OnMetaAgentCreated.invoke(created.createMetaAgentEvent())
+	}
+}
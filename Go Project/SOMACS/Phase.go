@@ -0,0 +1,196 @@
+package SOMACS
+
+import (
+	"fmt"
+	"sync"
+)
+
+const PHASE_PARTNER_SEARCH = "PartnerSearch"
+const PHASE_MAIN_COMMUNICATION = "MainCommunication"
+const PHASE_STATE_UPDATE = "StateUpdate"
+const PHASE_CLEANUP = "Cleanup"
+
+var defaultPhaseOrder = []string{PHASE_PARTNER_SEARCH, PHASE_MAIN_COMMUNICATION, PHASE_STATE_UPDATE, PHASE_CLEANUP}
+
+// Every phase is one turn of the base server. Setup is called before Handle and both receive the agents in order,
+// the turn ends once every agent has signalled that it finished messaging (or the turn times out).
+type Phase interface {
+	GetName() string
+	Setup(serv *Server, agents []IGenericAgent)
+	Handle(serv *Server, agents []IGenericAgent)
+}
+
+// Code for (1) Communication Partner Search
+
+type PartnerSearchPhase struct{}
+
+func (PartnerSearchPhase) GetName() string { return PHASE_PARTNER_SEARCH }
+
+func (PartnerSearchPhase) Setup(_ *Server, agents []IGenericAgent) {
+	for _, ag := range agents {
+		ag.setupCommunicationPartnerSearch()
+	}
+}
+
+func (PartnerSearchPhase) Handle(_ *Server, agents []IGenericAgent) {
+	for _, ag := range agents {
+		ag.handleCommunicationPartnerSearch()
+	}
+}
+
+// Code for (2) Main Communication Phase
+
+type MainCommunicationPhase struct{}
+
+func (MainCommunicationPhase) GetName() string { return PHASE_MAIN_COMMUNICATION }
+
+func (MainCommunicationPhase) Setup(_ *Server, agents []IGenericAgent) {
+	for _, ag := range agents {
+		ag.setupMainCommunicationPhase()
+	}
+}
+
+func (MainCommunicationPhase) Handle(_ *Server, agents []IGenericAgent) {
+	for _, ag := range agents {
+		ag.handleMainCommunicationPhase()
+	}
+}
+
+// Code for (3) State Update
+
+type StateUpdatePhase struct{}
+
+func (StateUpdatePhase) GetName() string { return PHASE_STATE_UPDATE }
+
+func (StateUpdatePhase) Setup(_ *Server, agents []IGenericAgent) {
+	for _, ag := range agents {
+		ag.setupStateUpdatePhase()
+	}
+}
+
+func (StateUpdatePhase) Handle(_ *Server, agents []IGenericAgent) {
+	for _, ag := range agents {
+		ag.handleStateUpdatePhase()
+	}
+}
+
+// Cleanup, always the last phase of an iteration
+
+type CleanupPhase struct{}
+
+func (CleanupPhase) GetName() string { return PHASE_CLEANUP }
+
+func (CleanupPhase) Setup(*Server, []IGenericAgent) {}
+
+func (CleanupPhase) Handle(serv *Server, _ []IGenericAgent) {
+	serv.compareShadowStates()
+	hasRemoved := serv.removePendingModelAgents()
+	serv.cleanupMetaAgents()
+	serv.applyPendingMerges()
+	if spawned := serv.spawnPendingModelAgents(); hasRemoved || len(spawned) > 0 {
+		serv.updateModelAgentReferences(spawned)
+	}
+	serv.saveStatesToMemory()
+	if serv.traceRecorder != nil {
+		serv.traceRecorder.recordIteration(serv)
+	}
+	serv.OnUpdateEnvironment.invoke(serv)
+	serv.OnIterationFinished.invoke(serv)
+	serv.iteration++
+	for _, ag := range serv.getAgentsInOrder() {
+		ag.SignalMessagingComplete()
+	}
+}
+
+// Custom phases that agents opt into with SetPhaseHandler, agents without a handler finish immediately
+
+type AgentPhase struct {
+	Name string
+}
+
+func CreateAgentPhase(name string) *AgentPhase {
+	return &AgentPhase{Name: name}
+}
+
+func (ap *AgentPhase) GetName() string { return ap.Name }
+
+func (ap *AgentPhase) Setup(_ *Server, agents []IGenericAgent) {
+	for _, ag := range agents {
+		ag.setupPhase(ap.Name)
+	}
+}
+
+func (ap *AgentPhase) Handle(_ *Server, agents []IGenericAgent) {
+	for _, ag := range agents {
+		ag.handlePhase(ap.Name)
+	}
+}
+
+// Setup runs before any agent handles the phase. Handle returns whether the agent is done, agents that keep
+// communicating return false and call SignalMessagingComplete themselves once finished.
+type PhaseHandler struct {
+	Setup  func()
+	Handle func() bool
+}
+
+type phaseHandlers map[string]PhaseHandler
+
+func (ph phaseHandlers) setup(phase string) {
+	handler, ok := ph[phase]
+	if ok && handler.Setup != nil {
+		handler.Setup()
+	}
+}
+
+func (ph phaseHandlers) handle(phase string) bool {
+	handler, ok := ph[phase]
+	if !ok || handler.Handle == nil {
+		return true
+	}
+	return handler.Handle()
+}
+
+// Phase registry
+
+var phaseMutex sync.RWMutex
+var phaseFactories = map[string]func() Phase{
+	PHASE_PARTNER_SEARCH:     func() Phase { return PartnerSearchPhase{} },
+	PHASE_MAIN_COMMUNICATION: func() Phase { return MainCommunicationPhase{} },
+	PHASE_STATE_UPDATE:       func() Phase { return StateUpdatePhase{} },
+	PHASE_CLEANUP:            func() Phase { return CleanupPhase{} },
+}
+
+func RegisterPhase(name string, factory func() Phase) {
+	phaseMutex.Lock()
+	phaseFactories[name] = factory
+	phaseMutex.Unlock()
+}
+
+func RegisterAgentPhase(name string) {
+	RegisterPhase(name, func() Phase { return CreateAgentPhase(name) })
+}
+
+func resolvePhases(names []string) ([]Phase, error) {
+	if len(names) == 0 {
+		names = defaultPhaseOrder
+	}
+	if names[len(names)-1] != PHASE_CLEANUP {
+		return nil, fmt.Errorf("last phase has to be (%v), was (%v)", PHASE_CLEANUP, names[len(names)-1])
+	}
+	phaseMutex.RLock()
+	defer phaseMutex.RUnlock()
+	phases := make([]Phase, len(names))
+	seen := make(map[string]bool, len(names))
+	for i, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("phase (%v) appears more than once", name)
+		}
+		seen[name] = true
+		factory, ok := phaseFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("no phase registered for name (%v)", name)
+		}
+		phases[i] = factory()
+	}
+	return phases, nil
+}
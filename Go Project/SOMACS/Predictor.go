@@ -0,0 +1,226 @@
+package SOMACS
+
+import (
+	"github.com/google/uuid"
+	"math"
+	"slices"
+	"sync"
+)
+
+// Ready-made predict functions for MetaAgentDefinition and ObserverAgent.ScheduleMetaAgent. Fitted predictors learn
+// how the number of messages of one type an agent receives relates to its state, from what an observer saw before
+// the agents were subsumed.
+
+type ObservationSample struct {
+	Agent        uuid.UUID
+	Iteration    int
+	MessageCount int
+	State        []byte
+}
+
+// Records how many messages of the type each observed model agent received per iteration. States are taken from the
+// state memory of the server, so only iterations within the state memory depth are available for fitting.
+type ObservationHistory struct {
+	serv        *Server
+	messageType int
+	counts      map[int]map[uuid.UUID]int
+	mutex       sync.Mutex
+}
+
+func CreateObservationHistory(oa *ObserverAgent, messageType int) *ObservationHistory {
+	oh := &ObservationHistory{serv: oa.serv, messageType: messageType, counts: make(map[int]map[uuid.UUID]int)}
+	record := func(statistics *ObserverStatistics) {
+		oh.record(&statistics.MessageStatistics, *oa.observedModelAgents)
+	}
+	oa.OnAfterAllStateUpdatesReceived.Subscribe(&record)
+	return oh
+}
+
+func (oh *ObservationHistory) record(messageStatistics *MessageStatistics, observedModelAgents []uuid.UUID) {
+	counts := make(map[uuid.UUID]int, len(observedModelAgents))
+	for _, id := range observedModelAgents {
+		msgs, _ := messageStatistics.GetMessagesOfTypeToAgent(id, oh.messageType)
+		counts[id] = len(msgs)
+	}
+	oh.mutex.Lock()
+	defer oh.mutex.Unlock()
+	oh.counts[oh.serv.iteration] = counts
+	for iteration := range oh.counts {
+		if iteration < oh.serv.iteration-oh.serv.maxStateMemoryDepth {
+			delete(oh.counts, iteration)
+		}
+	}
+}
+
+// The memory entry saved at the end of the iteration, iterations start at 0 like Server.iteration
+func (oh *ObservationHistory) getStates(iteration int) (map[uuid.UUID][]byte, bool) {
+	i := len(oh.serv.stateMemory) - (oh.serv.iteration - iteration)
+	if iteration >= oh.serv.iteration || i < 0 {
+		return nil, false
+	}
+	return oh.serv.stateMemory[i], true
+}
+
+// Exposed Functions
+
+func (oh *ObservationHistory) GetMessageType() int {
+	return oh.messageType
+}
+
+// Samples of the agents sorted by iteration and id, iterations without a state in memory are left out
+func (oh *ObservationHistory) GetSamples(agents []uuid.UUID) []ObservationSample {
+	oh.mutex.Lock()
+	defer oh.mutex.Unlock()
+	iterations := make([]int, 0, len(oh.counts))
+	for iteration := range oh.counts {
+		iterations = append(iterations, iteration)
+	}
+	slices.Sort(iterations)
+	sortedAgents := slices.SortedFunc(slices.Values(agents), compareIDs)
+	samples := make([]ObservationSample, 0)
+	for _, iteration := range iterations {
+		states, ok := oh.getStates(iteration)
+		if !ok {
+			continue
+		}
+		for _, id := range sortedAgents {
+			count, ok := oh.counts[iteration][id]
+			if !ok {
+				continue
+			}
+			state, ok := states[id]
+			if !ok {
+				continue
+			}
+			samples = append(samples, ObservationSample{id, iteration, count, state})
+		}
+	}
+	return samples
+}
+
+// Predictors
+
+// Every member keeps its current state
+func CreateLastValuePredictor() func(*MessageStatistics, *MetaState) map[uuid.UUID][]byte {
+	return func(_ *MessageStatistics, state *MetaState) map[uuid.UUID][]byte {
+		predictions := make(map[uuid.UUID][]byte, len(state.ModelStates))
+		for id, data := range state.ModelStates {
+			predictions[id] = data
+		}
+		return predictions
+	}
+}
+
+// Every member is set to the mean of the current member states, rounded for integer states
+func CreateMeanPredictor[T Number](codec StateCodec[T]) func(*MessageStatistics, *MetaState) map[uuid.UUID][]byte {
+	return TypedPredict(codec, func(_ *MessageStatistics, states map[uuid.UUID]T) map[uuid.UUID]T {
+		sum := 0.0
+		for _, value := range states {
+			sum += float64(value)
+		}
+		mean := fromFloat[T](sum / float64(max(len(states), 1)))
+		predictions := make(map[uuid.UUID]T, len(states))
+		for id := range states {
+			predictions[id] = mean
+		}
+		return predictions
+	})
+}
+
+// Fits state = intercept + slope * received messages by least squares on the samples of the agents. Without
+// samples members keep their state, without variance in the message counts the mean state is predicted.
+func CreateLinearRegressionPredictor[T Number](codec StateCodec[T], history *ObservationHistory, agents []uuid.UUID) func(*MessageStatistics, *MetaState) map[uuid.UUID][]byte {
+	samples := history.GetSamples(agents)
+	if len(samples) == 0 {
+		return CreateLastValuePredictor()
+	}
+	intercept, slope := fitLinearRegression(codec, samples)
+	history.serv.logger.Debug("linear regression predictor fitted", "samples", len(samples), "intercept", intercept, "slope", slope)
+	return TypedPredict(codec, func(messageStatistics *MessageStatistics, states map[uuid.UUID]T) map[uuid.UUID]T {
+		predictions := make(map[uuid.UUID]T, len(states))
+		for id := range states {
+			msgs, _ := messageStatistics.GetMessagesOfTypeToAgent(id, history.messageType)
+			predictions[id] = fromFloat[T](intercept + slope*float64(len(msgs)))
+		}
+		return predictions
+	})
+}
+
+// Predicts the mean state of the k samples whose message counts are closest to the messages a member received.
+// Ties are broken by sample order, so the earliest samples win. Without samples members keep their state.
+func CreateKNearestNeighbourPredictor[T Number](codec StateCodec[T], history *ObservationHistory, agents []uuid.UUID, k int) func(*MessageStatistics, *MetaState) map[uuid.UUID][]byte {
+	samples := history.GetSamples(agents)
+	if len(samples) == 0 || k < 1 {
+		return CreateLastValuePredictor()
+	}
+	counts := make([]int, len(samples))
+	values := make([]float64, len(samples))
+	for i, sample := range samples {
+		counts[i] = sample.MessageCount
+		values[i] = float64(mustDecode(codec, sample.State))
+	}
+	k = min(k, len(samples))
+	return TypedPredict(codec, func(messageStatistics *MessageStatistics, states map[uuid.UUID]T) map[uuid.UUID]T {
+		predictions := make(map[uuid.UUID]T, len(states))
+		order := make([]int, len(samples))
+		for id := range states {
+			msgs, _ := messageStatistics.GetMessagesOfTypeToAgent(id, history.messageType)
+			for i := range order {
+				order[i] = i
+			}
+			slices.SortStableFunc(order, func(a, b int) int {
+				return absInt(counts[a]-len(msgs)) - absInt(counts[b]-len(msgs))
+			})
+			sum := 0.0
+			for _, i := range order[:k] {
+				sum += values[i]
+			}
+			predictions[id] = fromFloat[T](sum / float64(k))
+		}
+		return predictions
+	})
+}
+
+// Helpers
+
+func fitLinearRegression[T Number](codec StateCodec[T], samples []ObservationSample) (float64, float64) {
+	n := float64(len(samples))
+	meanX, meanY := 0.0, 0.0
+	for _, sample := range samples {
+		meanX += float64(sample.MessageCount)
+		meanY += float64(mustDecode(codec, sample.State))
+	}
+	meanX /= n
+	meanY /= n
+	covariance, variance := 0.0, 0.0
+	for _, sample := range samples {
+		dx := float64(sample.MessageCount) - meanX
+		covariance += dx * (float64(mustDecode(codec, sample.State)) - meanY)
+		variance += dx * dx
+	}
+	if variance == 0 {
+		return meanY, 0
+	}
+	slope := covariance / variance
+	return meanY - slope*meanX, slope
+}
+
+// Rounds for integer types and clamps at zero for unsigned ones
+func fromFloat[T Number](value float64) T {
+	fraction := 0.5
+	if float64(T(fraction)) == fraction {
+		return T(value)
+	}
+	var zero T
+	if zero-1 > zero && value < 0 {
+		return zero
+	}
+	return T(math.Round(value))
+}
+
+func absInt(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,170 @@
+package SOMACS
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"os"
+)
+
+// Plays a recorded trace (s. Trace.go) back through observer style events so observer logic can be developed
+// without running the model agents. Message statistics are only available if the trace recorded messages.
+type Replay struct {
+	records    []TraceRecord
+	current    int
+	statistics ObserverStatistics
+	observed   []uuid.UUID
+
+	// Package Exposure
+	OnAfterAllStateUpdatesReceived Event[*ObserverStatistics]
+	OnIterationFinished            Event[*Replay]
+}
+
+func LoadReplay(r io.Reader) (*Replay, error) {
+	rp := &Replay{records: make([]TraceRecord, 0), current: -1}
+	decoder := json.NewDecoder(r)
+	for {
+		var record TraceRecord
+		err := decoder.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding trace record (%v): %w", len(rp.records)+1, err)
+		}
+		rp.records = append(rp.records, record)
+	}
+	rp.statistics.MessageStatistics.createMessageStatistics()
+	rp.statistics.StateStatistics.createStateStatistics()
+	rp.observed = make([]uuid.UUID, 0)
+	return rp, nil
+}
+
+func LoadReplayFile(path string) (*Replay, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadReplay(file)
+}
+
+// Rebuilds what an observer watching all not subsumed model agents and all meta agents saw during the state update of
+// the record. Membership is taken from the previous record since meta agents created in this iteration formed after
+// the statistics were gathered, states of meta agents come from this record where they still exist.
+func (rp *Replay) buildStatistics() {
+	rp.statistics.MessageStatistics.clear()
+	rp.statistics.StateStatistics.clear()
+	record := &rp.records[rp.current]
+
+	metaAgents := make([]MetaAgentSnapshot, 0)
+	if rp.current > 0 {
+		metaAgents = rp.records[rp.current-1].MetaAgents
+	}
+	current := make(map[uuid.UUID]MetaAgentSnapshot, len(record.MetaAgents))
+	for _, snapshot := range record.MetaAgents {
+		current[snapshot.Id] = snapshot
+	}
+
+	subsumed := make(map[uuid.UUID]bool)
+	metaStates := make(map[uuid.UUID]*MetaState, len(metaAgents))
+	for _, snapshot := range metaAgents {
+		dissolved := true
+		if updated, ok := current[snapshot.Id]; ok {
+			snapshot = updated
+			dissolved = updated.HasDissolved
+		}
+		childStates := make(map[uuid.UUID]*MetaState, len(snapshot.SubsumedMetaAgents))
+		for _, id := range snapshot.SubsumedMetaAgents {
+			childStates[id] = metaStates[id]
+			subsumed[id] = true
+		}
+		for _, id := range snapshot.SubsumedModelAgents {
+			subsumed[id] = true
+		}
+		state := &MetaState{}
+		state.createMetaState(snapshot.ModelStates, childStates)
+		metaStates[snapshot.Id] = state
+		rp.statistics.StateStatistics.recordMeta(snapshot.Id, state, dissolved)
+	}
+	rp.observed = rp.observed[:0]
+	observed := make(map[uuid.UUID]bool, len(record.ModelStates))
+	for _, id := range sortedIDs(record.ModelStates) {
+		if subsumed[id] {
+			continue
+		}
+		rp.observed = append(rp.observed, id)
+		observed[id] = true
+		rp.statistics.StateStatistics.states[id] = record.ModelStates[id]
+		rp.statistics.MessageStatistics.recordSignaledMainMessagingComplete(id)
+	}
+
+	// Observers clear their message statistics when the main communication phase starts
+	for _, traced := range record.Messages {
+		if traced.Phase == PHASE_PARTNER_SEARCH {
+			continue
+		}
+		if !observed[traced.Sender] && !observed[traced.Recipient] {
+			continue
+		}
+		msg := Message{MessageType: traced.MessageType, Data: traced.Data, Recipient: traced.Recipient}
+		msg.Sender = traced.Sender
+		rp.statistics.MessageStatistics.recordMessage(msg, traced.Phase)
+	}
+}
+
+// Exposed Functions
+
+// Advances to the next record and invokes the events, returns false once all records were played
+func (rp *Replay) Step() bool {
+	if rp.current+1 >= len(rp.records) {
+		return false
+	}
+	rp.current++
+	rp.buildStatistics()
+	rp.statistics.archive(rp.records[rp.current].Iteration)
+	rp.OnAfterAllStateUpdatesReceived.invoke(&rp.statistics)
+	rp.OnIterationFinished.invoke(rp)
+	return true
+}
+
+func (rp *Replay) Play() {
+	for rp.Step() {
+	}
+}
+
+func (rp *Replay) Reset() {
+	rp.current = -1
+	rp.statistics.history = nil
+	clear(rp.statistics.StateStatistics.series)
+}
+
+func (rp *Replay) GetRecords() []TraceRecord {
+	return rp.records
+}
+
+// Nil before the first step
+func (rp *Replay) GetCurrentRecord() *TraceRecord {
+	if rp.current < 0 {
+		return nil
+	}
+	return &rp.records[rp.current]
+}
+
+func (rp *Replay) GetIteration() int {
+	if rp.current < 0 {
+		return 0
+	}
+	return rp.records[rp.current].Iteration
+}
+
+func (rp *Replay) GetStatistics() *ObserverStatistics {
+	return &rp.statistics
+}
+
+// The model agents an observer using ObserveAllNotSubsumedModelAgents would have observed, sorted by id
+func (rp *Replay) GetObservedModelAgents() []uuid.UUID {
+	return rp.observed
+}
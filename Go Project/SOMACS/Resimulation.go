@@ -0,0 +1,248 @@
+package SOMACS
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"math/rand"
+	"slices"
+)
+
+type ResimulationReport struct {
+	Iterations       int
+	FinalStates      map[uuid.UUID][]byte
+	FinalEnvironment map[string][]byte
+	StateHistory     []map[uuid.UUID][]byte // Model agent states at the end of every resimulated iteration
+	Messages         *MessageStatistics     // Every message delivered to a model or meta agent
+
+	// Meta agents that existed at the start point are rebuilt under new ids, this maps memory ids to resimulated ids
+	RestoredMetaAgents  map[uuid.UUID]uuid.UUID
+	MetaAgentsFormed    []MetaAgentSnapshot // As they were at the end of the iteration they formed in
+	MetaAgentsDissolved []uuid.UUID
+	FinalMetaAgents     []MetaAgentSnapshot
+	FinalMetaHierarchy  []MetaHierarchySnapshot
+}
+
+// Replays the last iterations for a subset of model and observer agents on a separate server. Agents are cloned
+// (see Cloneable) and reset to the states in memory, meta agents are rebuilt from memory if all their members are
+// part of the subset. The memory of the live server is copied under its lock and every resim server draws ids from a
+// source of its own, so several resimulations can run side by side. The resim server starts without event
+// subscriptions since those of the live server may capture its state, so the environment keeps the variables it had at
+// the start of the resimulation.
+func (serv *Server) Resimulate(iterations int, agents []uuid.UUID) (report *ResimulationReport, err error) {
+	if iterations < 1 {
+		return nil, fmt.Errorf("resim iterations cannot be less than 1, was (%v)", iterations)
+	}
+	serv.memoryMutex.RLock()
+	stateMemory := slices.Clone(serv.stateMemory)
+	environmentMemory := slices.Clone(serv.environmentMemory)
+	metaAgentMemory := slices.Clone(serv.metaAgentMemory)
+	hierarchyMemory := slices.Clone(serv.hierarchyMemory)
+	serv.memoryMutex.RUnlock()
+	if iterations >= len(stateMemory) {
+		return nil, fmt.Errorf("resim iterations (%v) exceeds state memory depth (%v)", iterations, len(stateMemory)-1)
+	}
+	start := len(stateMemory) - 1 - iterations
+
+	defer func() {
+		if r := recover(); r != nil {
+			report = nil
+			err = fmt.Errorf("resimulation panicked: %v", r)
+		}
+	}()
+
+	resimServ, err := CreateServerFromConfig(&ServerConfig{
+		StateMemoryDepth: serv.maxStateMemoryDepth,
+		Iterations:       iterations,
+		MaxDuration:      ConfigDuration(serv.maxDuration),
+		AgentBandwidth:   serv.GetAgentMessagingBandwidth(),
+		Phases:           serv.GetPhases(),
+		Logger:           serv.logger.With("resimulation", true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Resims always deliver synchronously so cloned agents never touch the live server's message limiter
+	resimServ.seed = serv.seed
+	resimServ.isDeterministic = true
+	resimServ.idSource = &lockedRandReader{rng: rand.New(rand.NewSource(deriveSeed(serv.seed, -3)))}
+	resimServ.areInternalMessagesSynchronous = true
+	resimServ.iteration = serv.iteration - iterations
+	resimServ.restoreMetaAgentDefinition = serv.restoreMetaAgentDefinition
+	resimServ.environment.setHistory(serv.environment.GetHistory())
+	resimServ.environment.restore(environmentMemory[start], serv.environment.getLastIteration()-iterations)
+	resimServ.stateMemory = stateMemory[:start+1]
+	resimServ.environmentMemory = environmentMemory[:start+1]
+	resimServ.metaAgentMemory = metaAgentMemory[:start+1]
+	resimServ.hierarchyMemory = hierarchyMemory[:start+1]
+	resimServ.deliveredMessages = &MessageStatistics{}
+	resimServ.deliveredMessages.createMessageStatistics()
+
+	included := make(map[uuid.UUID]bool, len(agents))
+	for _, id := range agents {
+		_, isModel := serv.modelAgentMap[id]
+		_, isObserver := serv.observerAgentMap[id]
+		if !isModel && !isObserver {
+			return nil, fmt.Errorf("agent (%v) is not a model or observer agent of this server", id)
+		}
+		included[id] = true
+	}
+
+	// Cloned in live creation order so resims of the same subset visit agents in the same order
+	agentMap := serv.GetAgentMap()
+	for _, ids := range [][]uuid.UUID{serv.observerAgents, serv.modelAgents} {
+		for _, id := range ids {
+			if !included[id] {
+				continue
+			}
+			clone, err := cloneAgent(agentMap[id], resimServ)
+			if err != nil {
+				return nil, err
+			}
+			resimServ.AddAgent(clone)
+		}
+	}
+	for id, ma := range resimServ.modelAgentMap {
+		ma.state = stateMemory[start][id]
+	}
+	// Positions are not part of the memory, the current ones are used
+	if serv.partnerScope.space != nil {
+		space := serv.partnerScope.space.Clone()
+		for _, id := range serv.modelAgents {
+			if !included[id] {
+				space.Remove(id)
+			}
+		}
+		resimServ.SetSpace(space, serv.partnerScope.radius)
+	}
+	if serv.partnerScope.topology != nil {
+		resimServ.SetTopology(serv.partnerScope.topology.Subgraph(resimServ.modelAgents))
+	}
+	resimServ.metaHierarchy.createMetaHierarchy(resimServ.modelAgents)
+
+	idMap := make(map[uuid.UUID]uuid.UUID, len(resimServ.modelAgents))
+	for _, id := range resimServ.modelAgents {
+		idMap[id] = id
+	}
+	snapshots := resimServ.resimulatedMetaAgents(metaAgentMemory[start])
+	resimServ.restoreMetaAgents(snapshots, make(map[uuid.UUID]MetaAgentDefinition), idMap)
+	resimServ.metaHierarchy.restoreSnapshot(hierarchyMemory[start], idMap)
+	for _, oa := range resimServ.observerAgentMap {
+		observedModelAgents := slices.DeleteFunc(*oa.observedModelAgents, func(id uuid.UUID) bool {
+			ag, ok := resimServ.modelAgentMap[id]
+			return !ok || ag.isSubsumed
+		})
+		observedMetaAgents := slices.DeleteFunc(*oa.observedMetaAgents, func(id uuid.UUID) bool {
+			_, ok := resimServ.metaAgentMap[idMap[id]]
+			return !ok
+		})
+		for i, id := range observedMetaAgents {
+			observedMetaAgents[i] = idMap[id]
+		}
+		oa.observedModelAgents = &observedModelAgents
+		oa.observedMetaAgents = &observedMetaAgents
+	}
+
+	report = &ResimulationReport{
+		Iterations:          iterations,
+		StateHistory:        make([]map[uuid.UUID][]byte, 0, iterations),
+		Messages:            resimServ.deliveredMessages,
+		RestoredMetaAgents:  make(map[uuid.UUID]uuid.UUID, len(snapshots)),
+		MetaAgentsFormed:    make([]MetaAgentSnapshot, 0),
+		MetaAgentsDissolved: make([]uuid.UUID, 0),
+	}
+	for _, snapshot := range snapshots {
+		id, ok := idMap[snapshot.Id]
+		if ok {
+			report.RestoredMetaAgents[snapshot.Id] = id
+		}
+	}
+
+	seen := make(map[uuid.UUID]bool, len(resimServ.metaAgents))
+	for _, id := range resimServ.metaAgents {
+		seen[id] = true
+	}
+	onIterationFinished := func(resimServ *Server) {
+		report.StateHistory = append(report.StateHistory, resimServ.modelStates())
+		for _, snapshot := range resimServ.snapshotMetaAgents() {
+			if !seen[snapshot.Id] {
+				seen[snapshot.Id] = true
+				report.MetaAgentsFormed = append(report.MetaAgentsFormed, snapshot)
+			}
+		}
+		for _, id := range sortedIDs(seen) {
+			_, ok := resimServ.metaAgentMap[id]
+			if !ok && !slices.Contains(report.MetaAgentsDissolved, id) {
+				report.MetaAgentsDissolved = append(report.MetaAgentsDissolved, id)
+			}
+		}
+	}
+	resimServ.OnIterationFinished.Subscribe(&onIterationFinished)
+
+	resimServ.Start()
+
+	// Meta agents dissolving in the last iteration are only removed by the next cleanup
+	for _, id := range resimServ.metaAgents {
+		if resimServ.metaAgentMap[id].hasDissolved && !slices.Contains(report.MetaAgentsDissolved, id) {
+			report.MetaAgentsDissolved = append(report.MetaAgentsDissolved, id)
+		}
+	}
+	report.FinalStates = resimServ.modelStates()
+	report.FinalEnvironment = resimServ.environment.GetAll()
+	report.FinalMetaAgents = resimServ.snapshotMetaAgents()
+	report.FinalMetaHierarchy = resimServ.metaHierarchy.snapshot()
+	return report, nil
+}
+
+func cloneAgent(ag IGenericAgent, serv *Server) (IGenericAgent, error) {
+	var clone IGenericAgent
+	switch typed := ag.(type) {
+	case Cloneable:
+		clone = typed.Clone(serv)
+	case *ModelAgent:
+		clone = typed.CloneModelAgentBase(serv)
+	case *ObserverAgent:
+		clone = typed.CloneObserverAgentBase(serv)
+	default:
+		return nil, fmt.Errorf("agent (%v) of type %T does not implement Cloneable", ag.GetID(), ag)
+	}
+	_, isModel := serv.modelAgentMap[ag.GetID()]
+	_, isObserver := serv.observerAgentMap[ag.GetID()]
+	if clone == nil || clone.GetID() != ag.GetID() || (!isModel && !isObserver) {
+		return nil, fmt.Errorf("clone of agent (%v) was not created from CloneModelAgentBase or CloneObserverAgentBase", ag.GetID())
+	}
+	return clone, nil
+}
+
+// Meta agents from memory whose members are all part of the resim, children come before their parents in memory.
+// Definitions are rebuilt against the clones where possible since stored ones may capture the live agents.
+func (serv *Server) resimulatedMetaAgents(snapshots []MetaAgentSnapshot) []MetaAgentSnapshot {
+	accepted := make(map[uuid.UUID]bool, len(snapshots))
+	filtered := make([]MetaAgentSnapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		complete := true
+		for _, id := range snapshot.SubsumedModelAgents {
+			_, ok := serv.modelAgentMap[id]
+			complete = complete && ok
+		}
+		for _, id := range snapshot.SubsumedMetaAgents {
+			complete = complete && accepted[id]
+		}
+		if !complete {
+			continue
+		}
+		if serv.restoreMetaAgentDefinition != nil {
+			snapshot.definition, snapshot.hasDefinition = MetaAgentDefinition{}, false
+		}
+		accepted[snapshot.Id] = true
+		filtered = append(filtered, snapshot)
+	}
+	return filtered
+}
+
+func (serv *Server) modelStates() map[uuid.UUID][]byte {
+	states := make(map[uuid.UUID][]byte, len(serv.modelAgentMap))
+	for id, ma := range serv.modelAgentMap {
+		states[id] = ma.state
+	}
+	return states
+}
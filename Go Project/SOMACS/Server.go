@@ -1,10 +1,19 @@
 package SOMACS
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/MattSScott/basePlatformSOMAS/v2/pkg/message"
 	"github.com/MattSScott/basePlatformSOMAS/v2/pkg/server"
 	"github.com/google/uuid"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand"
 	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,125 +29,390 @@ type Server struct {
 
 	stateMemory         []map[uuid.UUID][]byte
 	environmentMemory   []map[string][]byte
+	metaAgentMemory     [][]MetaAgentSnapshot
+	hierarchyMemory     [][]MetaHierarchySnapshot
 	maxStateMemoryDepth int
+	memoryMutex         sync.RWMutex // Resimulations copy the memories from other goroutines
 
-	environmentVariables map[string][]byte
+	environment Environment
+
+	partnerScope partnerScope
 
 	metaHierarchy MetaHierarchy
 
+	// Iteration each group of model agents last dissolved in, kept for the longest observer cooldown
+	dissolvedGroups      map[string]int
+	maxMetaAgentCooldown int
+
+	// Applied at the cleanup turn, agents may queue changes from their own goroutines
+	pendingSpawns   []func(*Server) IGenericAgent
+	pendingRemovals []uuid.UUID
+	pendingMerges   [][2]uuid.UUID
+	pendingMutex    sync.Mutex
+
 	maxDuration time.Duration
+	iteration   int
+	phases      []Phase
+	currentTurn atomic.Int32 // Read by asynchronous deliveries
+
+	restoreMetaAgentDefinition func(*Server, []*ModelAgent, []*MetaAgent) MetaAgentDefinition
 
 	areInternalMessagesSynchronous bool
 
+	// Subsumed model agents keep computing their states for comparison (s. Shadow.go)
+	isShadowModeEnabled bool
+	shadowDistance      func([]byte, []byte) float64
+	shadowReports       []ShadowReport
+
+	logger *slog.Logger
+
+	// Deliveries to model and meta agents are recorded here if set
+	deliveredMessages *MessageStatistics
+	traceRecorder     *TraceRecorder
+
+	// For deterministic runs
+	seed            int64
+	isDeterministic bool
+	spawnedAgents   int
+	idSource        io.Reader
+
 	// Package Exposure
-	OnUpdateEnvironment Event[*Server]
-	OnIterationFinished Event[*Server]
+	OnUpdateEnvironment  Event[*Server]
+	OnIterationFinished  Event[*Server]
+	OnModelAgentSpawned  Event[*ModelAgent] // Place the agent in the space or connect it in the topology here
+	OnModelAgentRemoved  Event[uuid.UUID]
+	OnShadowReportsReady Event[[]ShadowReport]
+
+	// Meta agent lifecycle, s. MetaAgentLifecycle.go
+	OnMetaAgentCreated    Event[MetaAgentEvent]
+	OnMetaAgentVerified   Event[MetaAgentEvent]
+	OnMetaAgentDissolving Event[MetaAgentEvent] // Before the members are released at the end of the iteration
+	OnMetaAgentDissolved  Event[MetaAgentEvent]
+
+	OnMetaAgentMembersEjected Event[MetaAgentEvent] // Members holds the released agents (s. PartialDissolution.go)
 }
 
 func CreateServer(numModelAgents []int, createModelAgents []func(*Server) IGenericAgent,
 	numObserverAgents []int, createObserverAgents []func(*Server) IGenericAgent,
 	stateMemoryDepths int, iterations int, maxDuration time.Duration, agentBandwidth int) *Server {
+	config := &ServerConfig{
+		ModelAgents:          make([]AgentSpawnConfig, len(numModelAgents)),
+		ObserverAgents:       make([]AgentSpawnConfig, len(numObserverAgents)),
+		StateMemoryDepth:     stateMemoryDepths,
+		Iterations:           iterations,
+		MaxDuration:          ConfigDuration(maxDuration),
+		AgentBandwidth:       agentBandwidth,
+		EnvironmentVariables: make(map[string]ConfigBytes),
+	}
+	for i, num := range numModelAgents {
+		config.ModelAgents[i] = AgentSpawnConfig{Count: num, Factory: createModelAgents[i]}
+	}
+	for i, num := range numObserverAgents {
+		config.ObserverAgents[i] = AgentSpawnConfig{Count: num, Factory: createObserverAgents[i]}
+	}
+
+	serv, err := CreateServerFromConfig(config)
+	if err != nil {
+		panic(err)
+	}
+	return serv
+}
+
+func CreateServerFromConfig(config *ServerConfig) (*Server, error) {
+	createModelAgents, err := resolveAgentFactories(config.ModelAgents, modelAgentFactories)
+	if err != nil {
+		return nil, err
+	}
+	createObserverAgents, err := resolveAgentFactories(config.ObserverAgents, observerAgentFactories)
+	if err != nil {
+		return nil, err
+	}
+	phases, err := resolvePhases(config.Phases)
+	if err != nil {
+		return nil, err
+	}
+	if config.StateMemoryDepth < 0 {
+		return nil, fmt.Errorf("state memory depth cannot be negative, was (%v)", config.StateMemoryDepth)
+	}
+
 	modelCapacity := 0
-	for _, num := range numModelAgents {
-		modelCapacity += num
+	for _, spawn := range config.ModelAgents {
+		modelCapacity += spawn.Count
 	}
 	observerCapacity := 0
-	for _, num := range numObserverAgents {
-		observerCapacity += num
+	for _, spawn := range config.ObserverAgents {
+		observerCapacity += spawn.Count
 	}
 
+	maxDuration := time.Duration(config.MaxDuration)
 	serv := &Server{
-		BaseServer:           server.CreateBaseServer[IGenericAgent](iterations, 4, maxDuration, agentBandwidth),
-		modelAgents:          make([]uuid.UUID, 0, modelCapacity),
-		observerAgents:       make([]uuid.UUID, 0, observerCapacity),
-		metaAgents:           make([]uuid.UUID, 0),
-		modelAgentMap:        make(map[uuid.UUID]*ModelAgent, modelCapacity),
-		observerAgentMap:     make(map[uuid.UUID]*ObserverAgent, observerCapacity),
-		metaAgentMap:         make(map[uuid.UUID]*MetaAgent),
-		maxStateMemoryDepth:  stateMemoryDepths,
-		stateMemory:          make([]map[uuid.UUID][]byte, 0, stateMemoryDepths),
-		environmentMemory:    make([]map[string][]byte, 0, stateMemoryDepths),
-		environmentVariables: make(map[string][]byte),
+		BaseServer:          server.CreateBaseServer[IGenericAgent](config.Iterations, len(phases), maxDuration, config.AgentBandwidth),
+		modelAgents:         make([]uuid.UUID, 0, modelCapacity),
+		observerAgents:      make([]uuid.UUID, 0, observerCapacity),
+		metaAgents:          make([]uuid.UUID, 0),
+		modelAgentMap:       make(map[uuid.UUID]*ModelAgent, modelCapacity),
+		observerAgentMap:    make(map[uuid.UUID]*ObserverAgent, observerCapacity),
+		metaAgentMap:        make(map[uuid.UUID]*MetaAgent),
+		dissolvedGroups:     make(map[string]int),
+		maxStateMemoryDepth: config.StateMemoryDepth,
+		stateMemory:         make([]map[uuid.UUID][]byte, 0, config.StateMemoryDepth),
+		environmentMemory:   make([]map[string][]byte, 0, config.StateMemoryDepth),
+		metaAgentMemory:     make([][]MetaAgentSnapshot, 0, config.StateMemoryDepth),
+		hierarchyMemory:     make([][]MetaHierarchySnapshot, 0, config.StateMemoryDepth),
+		phases:              phases,
+	}
+	serv.SetLogger(config.Logger)
+	if config.TraceFile != "" {
+		serv.traceRecorder, err = CreateTraceRecorderFile(config.TraceFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	serv.currentTurn.Store(-1)
+	serv.environment.createEnvironment(config.EnvironmentVariables, config.EnvironmentHistoryDepth, &serv.iteration)
+
+	serv.seed = time.Now().UnixNano()
+	if config.Seed != nil {
+		serv.seed = *config.Seed
+		serv.isDeterministic = true
+		serv.idSource = &lockedRandReader{rng: rand.New(rand.NewSource(serv.seed))}
 	}
 
-	for i, num := range numObserverAgents {
-		for j := 0; j < num; j++ {
+	for i, spawn := range config.ObserverAgents {
+		for j := 0; j < spawn.Count; j++ {
 			serv.AddAgent(createObserverAgents[i](serv))
 		}
 	}
-	for i, num := range numModelAgents {
-		for j := 0; j < num; j++ {
+	for i, spawn := range config.ModelAgents {
+		for j := 0; j < spawn.Count; j++ {
 			serv.AddAgent(createModelAgents[i](serv))
 		}
 	}
 
-	serv.areInternalMessagesSynchronous = false
+	serv.areInternalMessagesSynchronous = config.InternalMessagesSynchronous || serv.isDeterministic
+	serv.SetShadowMode(config.ShadowMode, nil)
+
+	if config.Space != nil {
+		space, err := config.Space.createSpace()
+		if err != nil {
+			return nil, err
+		}
+		serv.SetSpace(space, config.Space.PartnerSearchRadius)
+		if config.Space.PlaceRandomly {
+			rng := rand.New(rand.NewSource(deriveSeed(serv.seed, -1)))
+			for _, id := range serv.modelAgents {
+				space.Place(id, space.GetRandomPosition(rng))
+			}
+		}
+	}
+	if config.Topology != nil {
+		topology, err := config.Topology.createTopology(serv.modelAgents, rand.New(rand.NewSource(deriveSeed(serv.seed, -2))))
+		if err != nil {
+			return nil, err
+		}
+		serv.SetTopology(topology)
+	}
 
 	serv.metaHierarchy.createMetaHierarchy(serv.modelAgents)
 	serv.maxDuration = maxDuration
 	serv.SetGameRunner(serv)
-	return serv
+	return serv, nil
 }
 
 // Internal running functions (partially exposed due to base package)
 
 func (serv *Server) RunTurn(iteration, turn int) {
-	fmt.Printf("Running iteration %v, turn %v\n", iteration+1, turn+1)
+	phase := serv.phases[turn]
+	serv.currentTurn.Store(int32(turn))
+	serv.logger.Debug("running turn", "iteration", iteration+1, "turn", turn+1, "phase", phase.GetName())
+	agents := serv.getAgentsInOrder()
+	phase.Setup(serv, agents)
+	phase.Handle(serv, agents)
+}
 
-	// Communication Partner Search
-	if turn == 0 {
-		for _, ag := range serv.GetAgentMap() {
-			ag.setupCommunicationPartnerSearch()
-		}
-		for _, ag := range serv.GetAgentMap() {
-			ag.handleCommunicationPartnerSearch()
+// Agents are visited in creation order (observers, model agents, meta agents) rather than in map order,
+// agents created during a turn are first visited in the next one
+func (serv *Server) getAgentsInOrder() []IGenericAgent {
+	agentMap := serv.GetAgentMap()
+	agents := make([]IGenericAgent, 0, len(agentMap))
+	for _, ids := range [][]uuid.UUID{serv.observerAgents, serv.modelAgents, serv.metaAgents} {
+		for _, id := range ids {
+			ag, ok := agentMap[id]
+			if ok {
+				agents = append(agents, ag)
+			}
 		}
 	}
+	return agents
+}
+
+func (serv *Server) createAgentRand() *rand.Rand {
+	index := serv.spawnedAgents
+	serv.spawnedAgents++
+	return rand.New(rand.NewSource(deriveSeed(serv.seed, index)))
+}
+
+// Ids of deterministic servers come from a source of their own, so servers running side by side keep their ids
+func (serv *Server) createAgentID() uuid.UUID {
+	if serv.idSource == nil {
+		return uuid.New()
+	}
+	return uuid.Must(uuid.NewRandomFromReader(serv.idSource))
+}
 
-	// Main Communication Phase
-	if turn == 1 {
-		for _, ag := range serv.GetAgentMap() {
-			ag.setupMainCommunicationPhase()
+func (serv *Server) cleanupMetaAgents() {
+	scheduledForDissolve := make([]*MetaAgent, 0, len(serv.metaAgents))
+	for _, id := range serv.metaAgents {
+		ag := serv.metaAgentMap[id]
+		if ag.hasDissolved {
+			scheduledForDissolve = append(scheduledForDissolve, ag)
 		}
-		for _, ag := range serv.GetAgentMap() {
-			ag.handleMainCommunicationPhase()
+	}
+
+	for _, ag := range scheduledForDissolve {
+		serv.removeDissolvedMetaAgent(ag)
+	}
+	serv.applyPartialDissolutions()
+	for key, iteration := range serv.dissolvedGroups {
+		if serv.iteration-iteration > serv.maxMetaAgentCooldown {
+			delete(serv.dissolvedGroups, key)
 		}
 	}
+}
 
-	// State update
-	if turn == 2 {
-		for _, ag := range serv.GetAgentMap() {
-			ag.setupStateUpdatePhase()
+func (serv *Server) removeDissolvedMetaAgent(ag *MetaAgent) {
+	serv.logger.Debug("meta agent dissolved", "iteration", serv.iteration+1, "metaAgent", ag.GetID(), "subsumedAgents", len(ag.subsumedAgents))
+	serv.dissolvedGroups[getGroupKey(ag.GetAllSubsumedModelAgentsRecursive())] = serv.iteration
+	serv.unsubsumeAgents(ag)
+	serv.deleteMetaAgent(ag)
+	if serv.traceRecorder != nil {
+		serv.traceRecorder.recordDissolveReason(ag.GetID(), ag.dissolveReason)
+	}
+	serv.OnMetaAgentDissolved.invoke(ag.createMetaAgentEvent())
+}
+
+// Removed agents leave their meta agent, which shrinks. A meta agent left with fewer than two members dissolves and
+// leaves its parent, which may dissolve in turn.
+func (serv *Server) removePendingModelAgents() bool {
+	serv.pendingMutex.Lock()
+	removals := serv.pendingRemovals
+	serv.pendingRemovals = nil
+	serv.pendingMutex.Unlock()
+
+	hasRemoved := false
+	for _, id := range removals {
+		ag, ok := serv.modelAgentMap[id]
+		if !ok {
+			serv.logger.Warn("removal skipped, agent is not a model agent", "iteration", serv.iteration+1, "agent", id)
+			continue
+		}
+		if ag.isSubsumed {
+			serv.removeFromMetaAgent(ag.subsumedBy, ag)
 		}
-		for _, ag := range serv.GetAgentMap() {
-			ag.handleStateUpdatePhase()
+		serv.metaHierarchy.removeAgent(id)
+		serv.modelAgents = slices.DeleteFunc(serv.modelAgents, func(cmp uuid.UUID) bool { return cmp == id })
+		delete(serv.modelAgentMap, id)
+		if serv.partnerScope.space != nil {
+			serv.partnerScope.space.Remove(id)
 		}
+		if serv.partnerScope.topology != nil {
+			serv.partnerScope.topology.RemoveNode(id)
+		}
+		serv.RemoveAgent(serv.GetAgentMap()[id])
+		serv.logger.Debug("model agent removed", "iteration", serv.iteration+1, "modelAgent", id)
+		serv.OnModelAgentRemoved.invoke(id)
+		hasRemoved = true
 	}
+	return hasRemoved
+}
 
-	// Cleanup
-	if turn == 3 {
-		serv.cleanupMetaAgents()
-		serv.saveStatesToMemory()
-		serv.OnUpdateEnvironment.invoke(serv)
-		serv.OnIterationFinished.invoke(serv)
-		for _, ag := range serv.GetAgentMap() {
-			ag.SignalMessagingComplete()
+func (serv *Server) removeFromMetaAgent(ma *MetaAgent, ag *ModelAgent) {
+	id := ag.GetID()
+	ma.subsumedModelAgents = slices.DeleteFunc(ma.subsumedModelAgents, func(cmp *ModelAgent) bool { return cmp == ag })
+	ma.subsumedAgents = slices.DeleteFunc(ma.subsumedAgents, func(cmp uuid.UUID) bool { return cmp == id })
+	delete(ma.state.ModelStates, id)
+	for parent := ma; parent != nil; parent = parent.subsumedBy {
+		delete(parent.condition.baseState, id)
+	}
+	// Parents losing a dissolved meta agent may fall below two members as well, the others only shrink
+	detail := fmt.Sprintf("model agent (%v) removed", id)
+	for current := ma; current != nil && len(current.subsumedAgents) < 2; {
+		current.dissolve(DISSOLVE_REASON_MEMBER_REMOVED, detail)
+		current = serv.detachFromParent(current)
+	}
+	ag.isSubsumed = false
+	ag.subsumedBy = nil
+}
+
+// The meta agent leaves its parent together with its members, returns the parent
+func (serv *Server) detachFromParent(ma *MetaAgent) *MetaAgent {
+	parent := ma.subsumedBy
+	if parent == nil {
+		return nil
+	}
+	parent.subsumedMetaAgents = slices.DeleteFunc(parent.subsumedMetaAgents, func(cmp *MetaAgent) bool { return cmp == ma })
+	parent.subsumedAgents = slices.DeleteFunc(parent.subsumedAgents, func(cmp uuid.UUID) bool { return cmp == ma.GetID() })
+	delete(parent.state.ChildStates, ma.GetID())
+	for id := range ma.state.GetModelStatesRecursive() {
+		for ancestor := parent; ancestor != nil; ancestor = ancestor.subsumedBy {
+			delete(ancestor.condition.baseState, id)
 		}
 	}
+	ma.isSubsumed = false
+	ma.subsumedBy = nil
+	serv.metaHierarchy.release(ma.GetID())
+	return parent
 }
 
-func (serv *Server) cleanupMetaAgents() {
-	scheduledForDissolve := make([]*MetaAgent, 0, len(serv.metaAgents))
-	for _, id := range serv.metaAgents {
-		ag := serv.metaAgentMap[id]
-		if ag.hasDissolved {
-			scheduledForDissolve = append(scheduledForDissolve, ag)
+// Spawned agents start out unsubsumed and are observed by every observer
+func (serv *Server) spawnPendingModelAgents() []uuid.UUID {
+	serv.pendingMutex.Lock()
+	spawns := serv.pendingSpawns
+	serv.pendingSpawns = nil
+	serv.pendingMutex.Unlock()
+
+	spawned := make([]uuid.UUID, 0, len(spawns))
+	for _, factory := range spawns {
+		ag := factory(serv)
+		ma, ok := serv.modelAgentMap[ag.GetID()]
+		if !ok {
+			// Observers register themselves on creation
+			serv.observerAgents = slices.DeleteFunc(serv.observerAgents, func(cmp uuid.UUID) bool { return cmp == ag.GetID() })
+			delete(serv.observerAgentMap, ag.GetID())
+			serv.logger.Error("spawned agent skipped, factory did not create a model agent", "iteration", serv.iteration+1, "agent", ag.GetID())
+			continue
 		}
+		serv.AddAgent(ag)
+		serv.metaHierarchy.addAgent(ma.GetID())
+		if serv.partnerScope.topology != nil {
+			serv.partnerScope.topology.AddNode(ma.GetID())
+		}
+		serv.logger.Debug("model agent spawned", "iteration", serv.iteration+1, "modelAgent", ma.GetID())
+		serv.OnModelAgentSpawned.invoke(ma)
+		spawned = append(spawned, ma.GetID())
 	}
+	return spawned
+}
 
-	for _, ag := range scheduledForDissolve {
-		serv.unsubsumeAgents(ag)
-		serv.deleteMetaAgent(ag)
+// External model agents and observation lists are refreshed after model agents were spawned or removed
+func (serv *Server) updateModelAgentReferences(spawned []uuid.UUID) {
+	for _, id := range serv.metaAgents {
+		ma := serv.metaAgentMap[id]
+		ma.externalModelAgents = ma.findExternalModelAgents(serv)
+	}
+	for _, id := range serv.observerAgents {
+		oa := serv.observerAgentMap[id]
+		observedModelAgents := slices.DeleteFunc(slices.Clone(*oa.observedModelAgents), func(id uuid.UUID) bool {
+			_, ok := serv.modelAgentMap[id]
+			return !ok
+		})
+		observedModelAgents = append(observedModelAgents, spawned...)
+		observedMetaAgents := slices.DeleteFunc(slices.Clone(*oa.observedMetaAgents), func(id uuid.UUID) bool {
+			_, ok := serv.metaAgentMap[id]
+			return !ok
+		})
+		oa.observedModelAgents = &observedModelAgents
+		oa.observedMetaAgents = &observedMetaAgents
 	}
 }
 
@@ -162,40 +436,92 @@ func (serv *Server) deleteMetaAgent(ag *MetaAgent) {
 	serv.metaHierarchy.dissolve(ag.GetID())
 	delete(serv.metaAgentMap, ag.GetID())
 	serv.RemoveAgent(ag)
+	forgetMetaAgent(ag.condition.policy, ag.GetID())
 }
 
 func (serv *Server) saveStatesToMemory() {
+	environment := serv.environment.snapshot(serv.iteration + 1)
 	if serv.maxStateMemoryDepth == 0 {
 		return
 	}
-	states := make(map[uuid.UUID][]byte)
-	for id, ma := range serv.modelAgentMap {
-		states[id] = ma.state
-	}
+	states, metaAgents, hierarchy := serv.modelStates(), serv.snapshotMetaAgents(), serv.metaHierarchy.snapshot()
+	serv.memoryMutex.Lock()
+	defer serv.memoryMutex.Unlock()
 	serv.stateMemory = append(serv.stateMemory, states)
 	if len(serv.stateMemory) > serv.maxStateMemoryDepth {
 		serv.stateMemory = serv.stateMemory[1:]
 	}
-	serv.environmentMemory = append(serv.environmentMemory, serv.environmentVariables)
+	serv.environmentMemory = append(serv.environmentMemory, environment)
 	if len(serv.environmentMemory) > serv.maxStateMemoryDepth {
 		serv.environmentMemory = serv.environmentMemory[1:]
 	}
+	serv.metaAgentMemory = append(serv.metaAgentMemory, metaAgents)
+	if len(serv.metaAgentMemory) > serv.maxStateMemoryDepth {
+		serv.metaAgentMemory = serv.metaAgentMemory[1:]
+	}
+	serv.hierarchyMemory = append(serv.hierarchyMemory, hierarchy)
+	if len(serv.hierarchyMemory) > serv.maxStateMemoryDepth {
+		serv.hierarchyMemory = serv.hierarchyMemory[1:]
+	}
+}
+
+// Overrides the base server delivery so messages can be recorded, messages to removed agents are dropped
+func (serv *Server) DeliverMessage(msg message.IMessage[IGenericAgent], recipient uuid.UUID) {
+	if _, ok := serv.GetAgentMap()[recipient]; !ok {
+		serv.logger.Debug("dropped message to unknown agent", "recipient", recipient)
+		return
+	}
+	if serv.deliveredMessages != nil || serv.traceRecorder != nil {
+		_, isObserver := serv.observerAgentMap[recipient]
+		typedMsg, ok := msg.(*Message)
+		if ok && !isObserver {
+			recorded := *typedMsg
+			recorded.Recipient = recipient
+			if serv.deliveredMessages != nil {
+				serv.deliveredMessages.recordMessage(recorded, serv.GetCurrentPhase())
+			}
+			if serv.traceRecorder != nil {
+				serv.traceRecorder.recordDelivery(serv.GetCurrentPhase(), recorded, recipient)
+			}
+		}
+	}
+	serv.BaseServer.DeliverMessage(msg, recipient)
 }
 
 func (serv *Server) RunStartOfIteration(i int) {
-	fmt.Printf("Starting iteration %v\n", i+1)
-	fmt.Println()
+	serv.logger.Info("starting iteration", "iteration", i+1)
 }
 
 func (serv *Server) RunEndOfIteration(i int) {
-	fmt.Println()
-	fmt.Printf("Ending iteration %v\n", i+1)
+	serv.logger.Info("ending iteration", "iteration", i+1)
 }
 
 // Exposed Getters/Setters
 
+func (serv *Server) GetIteration() int {
+	return serv.iteration
+}
+
+func (serv *Server) GetPhases() []string {
+	names := make([]string, len(serv.phases))
+	for i, phase := range serv.phases {
+		names[i] = phase.GetName()
+	}
+	return names
+}
+
+func (serv *Server) GetCurrentPhase() string {
+	turn := serv.currentTurn.Load()
+	if turn < 0 {
+		return ""
+	}
+	return serv.phases[turn].GetName()
+}
+
 func (serv *Server) GetStateMemory() []map[uuid.UUID][]byte {
-	return serv.stateMemory
+	serv.memoryMutex.RLock()
+	defer serv.memoryMutex.RUnlock()
+	return slices.Clone(serv.stateMemory)
 }
 
 func (serv *Server) GetObserverAgentMap() map[uuid.UUID]*ObserverAgent {
@@ -226,179 +552,268 @@ func (serv *Server) GetMetaHierarchy() *MetaHierarchy {
 	return &serv.metaHierarchy
 }
 
-func (serv *Server) GetEnvironmentVariables() map[string][]byte { return serv.environmentVariables }
+func (serv *Server) GetEnvironment() *Environment {
+	return &serv.environment
+}
+
+// The returned map is shared with the environment and must not be modified
+func (serv *Server) GetEnvironmentVariables() map[string][]byte { return serv.environment.GetAll() }
 
 func (serv *Server) GetEnvironmentVariable(name string) ([]byte, bool) {
-	value, ok := serv.environmentVariables[name]
-	return value, ok
+	return serv.environment.Get(name)
 }
 
 func (serv *Server) SetEnvironmentVariable(key string, value []byte) {
-	serv.environmentVariables[key] = value
+	serv.environment.Set(key, value)
+}
+
+func (serv *Server) GetEnvironmentAt(iteration int, key string) ([]byte, bool) {
+	return serv.environment.GetAt(iteration, key)
+}
+
+// Limits partner search to model agents within the radius of each other, nil removes the space
+func (serv *Server) SetSpace(space Space, partnerSearchRadius float64) {
+	serv.partnerScope.space = space
+	serv.partnerScope.radius = partnerSearchRadius
+}
+
+func (serv *Server) GetSpace() Space {
+	return serv.partnerScope.space
+}
+
+func (serv *Server) GetPartnerSearchRadius() float64 {
+	return serv.partnerScope.radius
+}
+
+// Limits partner search to graph neighbours, nil removes the topology. Set it before meta agents are created, their
+// external agents are taken from the topology on creation.
+func (serv *Server) SetTopology(topology *Topology) {
+	serv.partnerScope.topology = topology
+}
+
+func (serv *Server) GetTopology() *Topology {
+	return serv.partnerScope.topology
+}
+
+// The agent is created by the factory at the next cleanup turn, after removals and meta agent dissolution. Without
+// a topology edge or a position in the space it has no communication partners when partner search is restricted.
+// Factories creating anything but a model agent are skipped and logged as an error.
+func (serv *Server) SpawnModelAgent(factory func(*Server) IGenericAgent) {
+	serv.pendingMutex.Lock()
+	serv.pendingSpawns = append(serv.pendingSpawns, factory)
+	serv.pendingMutex.Unlock()
+}
+
+// The agent is removed at the next cleanup turn, ids that are no model agent by then are logged and skipped. Rollbacks
+// do not bring removed agents back.
+func (serv *Server) RemoveModelAgent(id uuid.UUID) {
+	serv.pendingMutex.Lock()
+	serv.pendingRemovals = append(serv.pendingRemovals, id)
+	serv.pendingMutex.Unlock()
 }
 
 func (serv *Server) SetInternalMessagesSynchronous(value bool) {
-	serv.areInternalMessagesSynchronous = value
+	serv.areInternalMessagesSynchronous = value || serv.isDeterministic
+}
+
+// Meta agent functions cannot be serialised. When a checkpoint is loaded into a server that never had the original
+// meta agent, this function is asked to rebuild its definition from the restored members.
+func (serv *Server) SetMetaAgentRestoreFunc(restore func(*Server, []*ModelAgent, []*MetaAgent) MetaAgentDefinition) {
+	serv.restoreMetaAgentDefinition = restore
+}
+
+// Passing nil silences the framework again
+func (serv *Server) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.New(discardHandler{})
+	}
+	serv.logger = logger
+}
+
+func (serv *Server) GetLogger() *slog.Logger {
+	return serv.logger
+}
+
+// Writes one trace record per iteration from now on, nil stops recording
+func (serv *Server) SetTraceRecorder(traceRecorder *TraceRecorder) {
+	serv.traceRecorder = traceRecorder
+}
+
+func (serv *Server) GetTraceRecorder() *TraceRecorder {
+	return serv.traceRecorder
 }
 
-// Rollback and Resim functionality below are in a fully untested and unfinished draft state.
-// These are NOT part of the core functionality of the framework and should be handled with care!
+func (serv *Server) IsDeterministic() bool {
+	return serv.isDeterministic
+}
+
+func (serv *Server) GetSeed() int64 {
+	return serv.seed
+}
+
+// Helpers
+
+// splitmix64 finaliser, spreads neighbouring agent indices over unrelated seeds
+func deriveSeed(seed int64, index int) int64 {
+	z := uint64(seed) + uint64(index+1)*0x9E3779B97F4A7C15
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return int64(z ^ (z >> 31))
+}
+
+func sortedIDs[V any](m map[uuid.UUID]V) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, compareIDs)
+	return ids
+}
+
+func compareIDs(a, b uuid.UUID) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+// slog only ships a discarding handler from go 1.24 on
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (dh discardHandler) WithAttrs([]slog.Attr) slog.Handler     { return dh }
+func (dh discardHandler) WithGroup(string) slog.Handler          { return dh }
+
+// Meta agents are created from the goroutines of the observers, rand.Rand is not safe for concurrent use
+type lockedRandReader struct {
+	rng   *rand.Rand
+	mutex sync.Mutex
+}
+
+func (lr *lockedRandReader) Read(p []byte) (int, error) {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	return lr.rng.Read(p)
+}
+
+// Rollback functionality below is in an early state.
+// It is NOT part of the core functionality of the framework and should be handled with care!
 
 var printedRollbackWarning = false
-var printedResimWarning = false
 
+// Restores the memory entry iterationsAgo entries from the end and drops it together with the entries after it, so
+// rolling back 1 iteration restores the last saved state
 func (serv *Server) RollbackState(iterationsAgo int) {
 	if !printedRollbackWarning {
-		fmt.Printf("WARNING! Rollback functionality is in early alpha state and may not work as intended. Please report problems on the github repository!\n")
+		serv.logger.Warn("rollback functionality is in early alpha state and may not work as intended, please report problems on the github repository")
 		printedRollbackWarning = true
 	}
 
 	if iterationsAgo < 1 {
-		fmt.Printf("Rollback iterations cannot be 0! Was chosen as (%v)\n", iterationsAgo)
+		serv.logger.Error("rollback iterations cannot be less than 1", "iterationsAgo", iterationsAgo)
 		return
 	}
 	if iterationsAgo > len(serv.stateMemory) {
-		fmt.Printf("Rollback iterations (%v) exceeds state memory depth (%v)\n", iterationsAgo, len(serv.stateMemory))
+		serv.logger.Error("rollback iterations exceed state memory depth", "iterationsAgo", iterationsAgo, "depth", len(serv.stateMemory))
 		return
 	}
 
-	fmt.Printf("Rolling back %v iterations.\n", iterationsAgo)
+	serv.logger.Info("rolling back", "iteration", serv.iteration, "iterationsAgo", iterationsAgo)
 
-	backupState := serv.stateMemory[len(serv.stateMemory)-iterationsAgo]
+	target := len(serv.stateMemory) - iterationsAgo
+	backupState := serv.stateMemory[target]
 	for id, agent := range serv.modelAgentMap {
-		agent.state = backupState[id]
+		state, ok := backupState[id]
+		if ok {
+			agent.state = state
+		}
 	}
-	serv.environmentVariables = serv.environmentMemory[len(serv.stateMemory)-iterationsAgo]
-
-	serv.stateMemory = serv.stateMemory[:len(serv.stateMemory)-iterationsAgo]
-	serv.environmentMemory = serv.environmentMemory[:len(serv.stateMemory)-iterationsAgo]
-
-	// reconstruct meta hierarchy?
+	serv.environment.restore(serv.environmentMemory[target], serv.environment.getLastIteration()-(iterationsAgo-1))
+	serv.rollbackMetaAgents(serv.metaAgentMemory[target], serv.hierarchyMemory[target])
+
+	serv.memoryMutex.Lock()
+	serv.stateMemory = serv.stateMemory[:target]
+	serv.environmentMemory = serv.environmentMemory[:target]
+	serv.metaAgentMemory = serv.metaAgentMemory[:target]
+	serv.hierarchyMemory = serv.hierarchyMemory[:target]
+	serv.memoryMutex.Unlock()
+	serv.iteration -= iterationsAgo - 1
 }
 
-func (serv *Server) Resimulate(iterations int, agents []uuid.UUID) map[uuid.UUID][]byte {
-	if !printedResimWarning {
-		fmt.Printf("WARNING! Resimulation functionality is in early alpha state and may not work as intended. Please report problems on the github repository!\n")
-		printedResimWarning = true
+// Meta agents that still exist with the same members are kept, all others are dissolved and missing ones recreated
+func (serv *Server) rollbackMetaAgents(snapshots []MetaAgentSnapshot, hierarchy []MetaHierarchySnapshot) {
+	idMap := make(map[uuid.UUID]uuid.UUID, len(serv.modelAgents)+len(snapshots))
+	for _, id := range serv.modelAgents {
+		idMap[id] = id
 	}
 
-	if iterations < 1 {
-		fmt.Printf("Resim iterations cannot be 0! Was chosen as (%v)\n", iterations)
-		return nil
-	}
-	if iterations > len(serv.stateMemory) {
-		fmt.Printf("Resim iterations (%v) exceeds state memory depth (%v)\n", iterations, len(serv.stateMemory))
-		return nil
+	// Decided bottom-up, a parent is only kept if all its children are, recreated children would get new ids
+	snapshotMap := make(map[uuid.UUID]MetaAgentSnapshot, len(snapshots))
+	for _, snapshot := range snapshots {
+		snapshotMap[snapshot.Id] = snapshot
 	}
-
-	// Create Local Resim Server, load agents & environment onto it
-	resimServ := CreateServer(make([]int, 0), make([]func(*Server) IGenericAgent, 0),
-		make([]int, 0), make([]func(*Server) IGenericAgent, 0),
-		serv.maxStateMemoryDepth, iterations, serv.maxDuration, serv.GetAgentMessagingBandwidth())
-
-	for _, id := range agents {
-		resimServ.AddAgent(serv.GetAgentMap()[id])
-	}
-
-	resimServ.environmentVariables = serv.environmentMemory[len(serv.stateMemory)-iterations]
-	resimServ.stateMemory = serv.stateMemory[:len(serv.stateMemory)-iterations]
-	resimServ.environmentMemory = serv.environmentMemory[:len(serv.stateMemory)-iterations]
-
-	// Backup current agent state & modify agents for resim
-	subsumedMap := make(map[uuid.UUID]*MetaAgent)
-	for id := range resimServ.GetAgentMap() {
-		modelAgent, ok := serv.modelAgentMap[id]
-		if ok {
-			resimServ.modelAgents = append(resimServ.modelAgents, id)
-			resimServ.modelAgentMap[id] = modelAgent
-
-			modelAgent.modelAgents = &resimServ.modelAgents
-			modelAgent.observerAgents = &resimServ.observerAgents
-			modelAgent.environment = &resimServ.environmentVariables
-			modelAgent.state = resimServ.stateMemory[len(resimServ.stateMemory)-1][id]
-
-			subsumedMap[id] = modelAgent.subsumedBy
-			if modelAgent.isSubsumed && !slices.Contains(agents, modelAgent.subsumedBy.GetID()) {
-				modelAgent.isSubsumed = false
-				modelAgent.subsumedBy = nil
-			}
+	kept := make(map[uuid.UUID]bool, len(snapshots))
+	decided := make(map[uuid.UUID]bool, len(snapshots))
+	var keep func(id uuid.UUID) bool
+	keep = func(id uuid.UUID) bool {
+		if decided[id] {
+			return kept[id]
 		}
-
-		metaAgent, ok := serv.metaAgentMap[id]
-		if ok {
-			resimServ.metaAgents = append(resimServ.metaAgents, id)
-			resimServ.metaAgentMap[id] = metaAgent
-
-			metaAgent.serv = resimServ
-			metaAgent.state.applyStateChange(resimServ.stateMemory[len(resimServ.stateMemory)-1])
-
-			subsumedMap[id] = metaAgent.subsumedBy
-			if metaAgent.isSubsumed && !slices.Contains(agents, metaAgent.subsumedBy.GetID()) {
-				metaAgent.isSubsumed = false
-				metaAgent.subsumedBy = nil
+		decided[id] = true
+		snapshot, ok := snapshotMap[id]
+		if !ok {
+			return false
+		}
+		for _, child := range snapshot.SubsumedMetaAgents {
+			if !keep(child) {
+				return false
 			}
 		}
-
-		observerAgent, ok := serv.observerAgentMap[id]
-		if ok {
-			resimServ.observerAgents = append(resimServ.observerAgents, id)
-			resimServ.observerAgentMap[id] = observerAgent
-
-			observerAgent.modelAgents = &resimServ.modelAgents
-			observerAgent.metaAgents = &resimServ.metaAgents
-			observerAgent.observedModelAgents, observerAgent.observedMetaAgents = observerAgent.observationStrategy()
-			observerAgent.serv = resimServ
+		if ma, ok := serv.metaAgentMap[id]; ok && ma.hasSubsumedExactly(snapshot.SubsumedModelAgents, snapshot.SubsumedMetaAgents) {
+			kept[id] = true
 		}
+		return kept[id]
 	}
-	resimServ.metaHierarchy.createMetaHierarchy(resimServ.modelAgents)
-	for _, ma := range resimServ.metaAgentMap {
-		resimServ.metaHierarchy.subsume(ma.GetID(), ma.subsumedAgents)
+	for _, snapshot := range snapshots {
+		keep(snapshot.Id)
 	}
-
-	// Perform resimulation
-	for i := range iterations {
-		for j := range 4 {
-			resimServ.RunTurn(i, j)
+	for _, id := range slices.Clone(serv.metaAgents) {
+		if kept[id] {
+			continue
 		}
+		ma := serv.metaAgentMap[id]
+		serv.unsubsumeAgents(ma)
+		serv.deleteMetaAgent(ma)
 	}
-	resultState := resimServ.stateMemory[len(resimServ.stateMemory)-1]
 
-	// Reset agents back to original
-	for id := range resimServ.GetAgentMap() {
-		modelAgent, ok := serv.modelAgentMap[id]
-		if ok {
-			modelAgent.modelAgents = &serv.modelAgents
-			modelAgent.observerAgents = &serv.observerAgents
-			modelAgent.environment = &serv.environmentVariables
-			modelAgent.state = serv.stateMemory[len(serv.stateMemory)-1][id]
-
-			subsumedBy, ok := subsumedMap[id]
-			if ok && subsumedBy != nil {
-				modelAgent.isSubsumed = true
-				modelAgent.subsumedBy = subsumedBy
-			}
+	missing := make([]MetaAgentSnapshot, 0, len(snapshots)-len(kept))
+	for _, snapshot := range snapshots {
+		if !kept[snapshot.Id] {
+			missing = append(missing, snapshot)
+			continue
 		}
-
-		metaAgent, ok := serv.metaAgentMap[id]
-		if ok {
-			metaAgent.serv = serv
-			metaAgent.state.applyStateChange(serv.stateMemory[len(serv.stateMemory)-1])
-
-			subsumedBy, ok := subsumedMap[id]
-			if ok && subsumedBy != nil {
-				metaAgent.isSubsumed = true
-				metaAgent.subsumedBy = subsumedBy
-			}
-		}
-
-		observerAgent, ok := serv.observerAgentMap[id]
-		if ok {
-			observerAgent.modelAgents = &serv.modelAgents
-			observerAgent.metaAgents = &serv.metaAgents
-			observerAgent.observedModelAgents, observerAgent.observedMetaAgents = observerAgent.observationStrategy()
-			observerAgent.serv = serv
+		ma := serv.metaAgentMap[snapshot.Id]
+		ma.state.ModelStates = maps.Clone(snapshot.ModelStates)
+		ma.condition.baseState = maps.Clone(snapshot.BaseState)
+		ma.hasDissolved = snapshot.HasDissolved
+		idMap[snapshot.Id] = snapshot.Id
+	}
+	serv.restoreMetaAgents(missing, make(map[uuid.UUID]MetaAgentDefinition), idMap)
+	serv.metaHierarchy.restoreSnapshot(hierarchy, idMap)
+	for _, id := range serv.modelAgents {
+		if _, ok := serv.metaHierarchy.GetNodeByID(id); !ok {
+			serv.metaHierarchy.addAgent(id) // Spawned after the target iteration
 		}
 	}
 
-	return resultState
+	for _, oa := range serv.observerAgentMap {
+		observedModelAgents := slices.DeleteFunc(slices.Clone(*oa.observedModelAgents), func(id uuid.UUID) bool {
+			ag, ok := serv.modelAgentMap[id]
+			return !ok || ag.isSubsumed
+		})
+		observedMetaAgents := slices.DeleteFunc(slices.Clone(*oa.observedMetaAgents), func(id uuid.UUID) bool {
+			_, ok := serv.metaAgentMap[id]
+			return !ok
+		})
+		oa.observedModelAgents = &observedModelAgents
+		oa.observedMetaAgents = &observedMetaAgents
+	}
 }
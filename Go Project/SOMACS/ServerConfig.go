@@ -0,0 +1,225 @@
+package SOMACS
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AgentSpawnConfig struct {
+	Type    string                      `json:"type" yaml:"type"`
+	Count   int                         `json:"count" yaml:"count"`
+	Factory func(*Server) IGenericAgent `json:"-" yaml:"-"` // Overrides the registry lookup by Type if set
+}
+
+type ServerConfig struct {
+	ModelAgents                 []AgentSpawnConfig     `json:"modelAgents" yaml:"modelAgents"`
+	ObserverAgents              []AgentSpawnConfig     `json:"observerAgents" yaml:"observerAgents"`
+	StateMemoryDepth            int                    `json:"stateMemoryDepth" yaml:"stateMemoryDepth"`
+	Iterations                  int                    `json:"iterations" yaml:"iterations"`
+	MaxDuration                 ConfigDuration         `json:"maxDuration" yaml:"maxDuration"`
+	AgentBandwidth              int                    `json:"agentBandwidth" yaml:"agentBandwidth"`
+	InternalMessagesSynchronous bool                   `json:"internalMessagesSynchronous" yaml:"internalMessagesSynchronous"`
+	EnvironmentVariables        map[string]ConfigBytes `json:"environmentVariables" yaml:"environmentVariables"`
+
+	// Number of iterations the environment history keeps for GetEnvironmentAt, unlimited if 0
+	EnvironmentHistoryDepth int `json:"environmentHistoryDepth,omitempty" yaml:"environmentHistoryDepth,omitempty"`
+
+	// Places model agents in a space and limits partner search to nearby agents (s. Space.go)
+	Space *SpaceConfig `json:"space,omitempty" yaml:"space,omitempty"`
+
+	// Connects the model agents in a graph and limits partner search to neighbours (s. Topology.go)
+	Topology *TopologyConfig `json:"topology,omitempty" yaml:"topology,omitempty"`
+
+	// Compares the predictions of meta agents to the states their members would have computed (s. Shadow.go), states
+	// count as matching or not unless a distance is set with Server.SetShadowMode
+	ShadowMode bool `json:"shadowMode,omitempty" yaml:"shadowMode,omitempty"`
+
+	// Phase names in the order they run each iteration, the default order is used if empty (s. Phase.go)
+	Phases []string `json:"phases,omitempty" yaml:"phases,omitempty"`
+
+	// Setting a seed makes the run deterministic: agent ids and agent RNGs are derived from it and all messages are
+	// delivered synchronously.
+	Seed *int64 `json:"seed,omitempty" yaml:"seed,omitempty"`
+
+	// Writes a JSON Lines trace of the run to this file if set (s. Trace.go), close it with GetTraceRecorder().Close()
+	TraceFile string `json:"traceFile,omitempty" yaml:"traceFile,omitempty"`
+
+	// Framework log records go here, nothing is logged if unset
+	Logger *slog.Logger `json:"-" yaml:"-"`
+}
+
+// Durations are written as strings such as "100ms" in scenario files
+type ConfigDuration time.Duration
+
+func (cd ConfigDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(cd).String())
+}
+
+func (cd *ConfigDuration) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return cd.parse(value)
+}
+
+func (cd ConfigDuration) MarshalYAML() (any, error) {
+	return time.Duration(cd).String(), nil
+}
+
+func (cd *ConfigDuration) UnmarshalYAML(node *yaml.Node) error {
+	var value any
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+	return cd.parse(value)
+}
+
+func (cd *ConfigDuration) parse(value any) error {
+	switch v := value.(type) {
+	case string:
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*cd = ConfigDuration(duration)
+	case float64:
+		*cd = ConfigDuration(time.Duration(v))
+	case int:
+		*cd = ConfigDuration(time.Duration(v))
+	default:
+		return fmt.Errorf("invalid duration (%v)", value)
+	}
+	return nil
+}
+
+// Values are written as lists of bytes such as [5] in JSON and YAML alike, JSON would encode []byte as base64
+type ConfigBytes []byte
+
+func (cb ConfigBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cb.values())
+}
+
+func (cb *ConfigBytes) UnmarshalJSON(data []byte) error {
+	var values []int
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("bytes have to be written as a list of numbers: %v", err)
+	}
+	return cb.parse(values)
+}
+
+func (cb ConfigBytes) MarshalYAML() (any, error) {
+	return cb.values(), nil
+}
+
+func (cb *ConfigBytes) UnmarshalYAML(node *yaml.Node) error {
+	var values []int
+	if err := node.Decode(&values); err != nil {
+		return fmt.Errorf("bytes have to be written as a list of numbers: %v", err)
+	}
+	return cb.parse(values)
+}
+
+func (cb ConfigBytes) values() []int {
+	values := make([]int, len(cb))
+	for i, b := range cb {
+		values[i] = int(b)
+	}
+	return values
+}
+
+func (cb *ConfigBytes) parse(values []int) error {
+	bytes := make(ConfigBytes, len(values))
+	for i, value := range values {
+		if value < 0 || value > 255 {
+			return fmt.Errorf("invalid byte (%v)", value)
+		}
+		bytes[i] = byte(value)
+	}
+	*cb = bytes
+	return nil
+}
+
+// Agent factory registry
+
+var agentFactoryMutex sync.RWMutex
+var modelAgentFactories = map[string]func(*Server) IGenericAgent{"ModelAgent": createModelAgent}
+var observerAgentFactories = map[string]func(*Server) IGenericAgent{"ObserverAgent": createObserverAgent}
+
+func RegisterModelAgentFactory(name string, factory func(*Server) IGenericAgent) {
+	agentFactoryMutex.Lock()
+	modelAgentFactories[name] = factory
+	agentFactoryMutex.Unlock()
+}
+
+func RegisterObserverAgentFactory(name string, factory func(*Server) IGenericAgent) {
+	agentFactoryMutex.Lock()
+	observerAgentFactories[name] = factory
+	agentFactoryMutex.Unlock()
+}
+
+func resolveAgentFactories(spawns []AgentSpawnConfig, registry map[string]func(*Server) IGenericAgent) ([]func(*Server) IGenericAgent, error) {
+	agentFactoryMutex.RLock()
+	defer agentFactoryMutex.RUnlock()
+	factories := make([]func(*Server) IGenericAgent, len(spawns))
+	for i, spawn := range spawns {
+		if spawn.Count < 0 {
+			return nil, fmt.Errorf("agent count for type (%v) cannot be negative, was (%v)", spawn.Type, spawn.Count)
+		}
+		if spawn.Factory != nil {
+			factories[i] = spawn.Factory
+			continue
+		}
+		factory, ok := registry[spawn.Type]
+		if !ok {
+			return nil, fmt.Errorf("no agent factory registered for type (%v)", spawn.Type)
+		}
+		factories[i] = factory
+	}
+	return factories, nil
+}
+
+// Loading
+
+func LoadServerConfigJSON(r io.Reader) (*ServerConfig, error) {
+	config := &ServerConfig{}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("decoding json server config: %w", err)
+	}
+	return config, nil
+}
+
+func LoadServerConfigYAML(r io.Reader) (*ServerConfig, error) {
+	config := &ServerConfig{}
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("decoding yaml server config: %w", err)
+	}
+	return config, nil
+}
+
+func LoadServerConfigFile(path string) (*ServerConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return LoadServerConfigJSON(file)
+	case ".yaml", ".yml":
+		return LoadServerConfigYAML(file)
+	}
+	return nil, fmt.Errorf("unknown server config format (%v), expected .json, .yaml or .yml", filepath.Ext(path))
+}
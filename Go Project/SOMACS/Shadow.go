@@ -0,0 +1,89 @@
+package SOMACS
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"math"
+)
+
+// In shadow mode subsumed model agents still run their state update function, the result is compared to the state
+// predicted by their top level meta agent at the end of every iteration. The shadow states are never applied.
+type ShadowReport struct {
+	Iteration         int // Starting at 1
+	MetaAgent         uuid.UUID
+	Samples           int
+	MeanAbsoluteError float64
+	MaxError          float64
+	ExactMatchRate    float64
+}
+
+func (serv *Server) compareShadowStates() {
+	if !serv.isShadowModeEnabled {
+		return
+	}
+	serv.shadowReports = make([]ShadowReport, 0, len(serv.metaAgents))
+	for _, id := range serv.metaAgents {
+		ma := serv.metaAgentMap[id]
+		if ma.isSubsumed {
+			continue
+		}
+		report := ShadowReport{Iteration: serv.iteration + 1, MetaAgent: id}
+		predictions := ma.state.GetModelStatesRecursive()
+		for _, member := range sortedIDs(predictions) {
+			ag, ok := serv.modelAgentMap[member]
+			if !ok || !ag.hasShadowState {
+				continue
+			}
+			distance := serv.shadowDistance(predictions[member], ag.shadowState)
+			report.Samples++
+			report.MeanAbsoluteError += distance
+			report.MaxError = math.Max(report.MaxError, distance)
+			if bytes.Equal(predictions[member], ag.shadowState) {
+				report.ExactMatchRate++
+			}
+			ag.hasShadowState = false
+		}
+		if report.Samples == 0 {
+			continue
+		}
+		report.MeanAbsoluteError /= float64(report.Samples)
+		report.ExactMatchRate /= float64(report.Samples)
+		serv.shadowReports = append(serv.shadowReports, report)
+	}
+	serv.OnShadowReportsReady.invoke(serv.shadowReports)
+}
+
+// Default distance of the shadow mode, 0 for equal states and 1 otherwise
+func exactStateDistance(predicted, actual []byte) float64 {
+	if bytes.Equal(predicted, actual) {
+		return 0
+	}
+	return 1
+}
+
+// Exposed Functions
+
+// Absolute difference of numeric states, for Server.SetShadowMode
+func NumericStateDistance[T Number](codec StateCodec[T]) func([]byte, []byte) float64 {
+	return func(predicted, actual []byte) float64 {
+		return math.Abs(float64(mustDecode(codec, predicted)) - float64(mustDecode(codec, actual)))
+	}
+}
+
+// Errors are measured with the distance, states only count as matching or not if it is nil
+func (serv *Server) SetShadowMode(isEnabled bool, distance func(predicted, actual []byte) float64) {
+	if distance == nil {
+		distance = exactStateDistance
+	}
+	serv.isShadowModeEnabled = isEnabled
+	serv.shadowDistance = distance
+}
+
+func (serv *Server) IsShadowModeEnabled() bool {
+	return serv.isShadowModeEnabled
+}
+
+// Reports of the last iteration, one per top level meta agent with compared members
+func (serv *Server) GetShadowReports() []ShadowReport {
+	return serv.shadowReports
+}
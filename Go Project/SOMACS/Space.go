@@ -0,0 +1,301 @@
+package SOMACS
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
+)
+
+const SPACE_GRID = "grid"
+const SPACE_CONTINUOUS = "continuous"
+
+type Position struct {
+	X float64
+	Y float64
+}
+
+// Model agents placed in a space only search for communication partners within the partner search radius of the
+// server. Distances are symmetric, so every agent receives exactly as many requests as it sends. Positions are not
+// part of the state memory.
+type Space interface {
+	Place(id uuid.UUID, position Position) error
+	Remove(id uuid.UUID)
+	GetPosition(id uuid.UUID) (Position, bool)
+	GetDistance(a, b uuid.UUID) (float64, bool)
+	GetNeighbours(id uuid.UUID, radius float64) []uuid.UUID // Sorted by id, without the agent itself
+	GetRandomPosition(rng *rand.Rand) Position
+	Clone() Space
+}
+
+// Shared by both spaces: agents are bucketed into square cells so neighbourhood queries only visit nearby cells
+type spaceIndex struct {
+	width     float64
+	height    float64
+	isTorus   bool
+	cellSize  float64
+	positions map[uuid.UUID]Position
+	cells     map[[2]int][]uuid.UUID
+	mutex     sync.RWMutex
+}
+
+func (si *spaceIndex) createSpaceIndex(width, height float64, isTorus bool, cellSize float64) {
+	if width <= 0 || height <= 0 {
+		panic(fmt.Sprintf("Space dimensions have to be positive, were (%v, %v)", width, height))
+	}
+	si.width = width
+	si.height = height
+	si.isTorus = isTorus
+	si.cellSize = cellSize
+	si.positions = make(map[uuid.UUID]Position)
+	si.cells = make(map[[2]int][]uuid.UUID)
+}
+
+func (si *spaceIndex) cellOf(position Position) [2]int {
+	return [2]int{int(math.Floor(position.X / si.cellSize)), int(math.Floor(position.Y / si.cellSize))}
+}
+
+func (si *spaceIndex) cellCount() (int, int) {
+	return int(math.Ceil(si.width / si.cellSize)), int(math.Ceil(si.height / si.cellSize))
+}
+
+func (si *spaceIndex) place(id uuid.UUID, position Position) error {
+	if position.X < 0 || position.Y < 0 || position.X >= si.width || position.Y >= si.height {
+		return fmt.Errorf("position (%v, %v) is outside of the space (%v x %v)", position.X, position.Y, si.width, si.height)
+	}
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+	si.remove(id)
+	si.positions[id] = position
+	cell := si.cellOf(position)
+	si.cells[cell] = append(si.cells[cell], id)
+	return nil
+}
+
+// Has to be called with the lock held
+func (si *spaceIndex) remove(id uuid.UUID) {
+	position, ok := si.positions[id]
+	if !ok {
+		return
+	}
+	delete(si.positions, id)
+	cell := si.cellOf(position)
+	si.cells[cell] = slices.DeleteFunc(si.cells[cell], func(other uuid.UUID) bool { return other == id })
+	if len(si.cells[cell]) == 0 {
+		delete(si.cells, cell)
+	}
+}
+
+func (si *spaceIndex) delta(a, b, size float64) float64 {
+	d := math.Abs(a - b)
+	if si.isTorus && d > size/2 {
+		d = size - d
+	}
+	return d
+}
+
+// Visits every agent in the cells within the radius of the position, cells wrap around on a torus. The reach is capped
+// at the size of the grid, so large radii visit every cell once instead of looping over cells that do not exist.
+func (si *spaceIndex) visitNearby(position Position, radius float64, visit func(uuid.UUID)) {
+	center := si.cellOf(position)
+	columns, rows := si.cellCount()
+	reach := math.Ceil(radius / si.cellSize)
+	reachX, reachY := int(math.Min(reach, float64(columns))), int(math.Min(reach, float64(rows)))
+	visited := make(map[[2]int]bool)
+	for dx := -reachX; dx <= reachX; dx++ {
+		for dy := -reachY; dy <= reachY; dy++ {
+			cell := [2]int{center[0] + dx, center[1] + dy}
+			if si.isTorus {
+				cell = [2]int{((cell[0] % columns) + columns) % columns, ((cell[1] % rows) + rows) % rows}
+			}
+			if visited[cell] {
+				continue
+			}
+			visited[cell] = true
+			for _, id := range si.cells[cell] {
+				visit(id)
+			}
+		}
+	}
+}
+
+func (si *spaceIndex) neighbours(id uuid.UUID, radius float64, distance func(Position, Position) float64) []uuid.UUID {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+	position, ok := si.positions[id]
+	if !ok {
+		return make([]uuid.UUID, 0)
+	}
+	neighbours := make([]uuid.UUID, 0)
+	si.visitNearby(position, radius, func(other uuid.UUID) {
+		if other != id && distance(position, si.positions[other]) <= radius {
+			neighbours = append(neighbours, other)
+		}
+	})
+	slices.SortFunc(neighbours, compareIDs)
+	return neighbours
+}
+
+func (si *spaceIndex) cloneInto(clone *spaceIndex) {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+	clone.width, clone.height, clone.isTorus, clone.cellSize = si.width, si.height, si.isTorus, si.cellSize
+	clone.positions = maps.Clone(si.positions)
+	clone.cells = make(map[[2]int][]uuid.UUID, len(si.cells))
+	for cell, ids := range si.cells {
+		clone.cells[cell] = slices.Clone(ids)
+	}
+}
+
+func (si *spaceIndex) getPosition(id uuid.UUID) (Position, bool) {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+	position, ok := si.positions[id]
+	return position, ok
+}
+
+func (si *spaceIndex) getDistance(a, b uuid.UUID, distance func(Position, Position) float64) (float64, bool) {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+	positionA, okA := si.positions[a]
+	positionB, okB := si.positions[b]
+	if !okA || !okB {
+		return 0, false
+	}
+	return distance(positionA, positionB), true
+}
+
+// Grid with integer cells, several agents may share a cell. Distances are counted in steps including diagonal ones
+// (Moore neighbourhood), a radius of 1 covers the 8 surrounding cells.
+type GridSpace struct {
+	index spaceIndex
+}
+
+func CreateGridSpace(width, height int, isTorus bool) *GridSpace {
+	gs := &GridSpace{}
+	gs.index.createSpaceIndex(float64(width), float64(height), isTorus, 1)
+	return gs
+}
+
+func (gs *GridSpace) distance(a, b Position) float64 {
+	return math.Max(gs.index.delta(a.X, b.X, gs.index.width), gs.index.delta(a.Y, b.Y, gs.index.height))
+}
+
+// Positions are truncated to their cell
+func (gs *GridSpace) Place(id uuid.UUID, position Position) error {
+	return gs.index.place(id, Position{math.Floor(position.X), math.Floor(position.Y)})
+}
+
+func (gs *GridSpace) Remove(id uuid.UUID) {
+	gs.index.mutex.Lock()
+	gs.index.remove(id)
+	gs.index.mutex.Unlock()
+}
+
+func (gs *GridSpace) GetPosition(id uuid.UUID) (Position, bool) {
+	return gs.index.getPosition(id)
+}
+
+func (gs *GridSpace) GetDistance(a, b uuid.UUID) (float64, bool) {
+	return gs.index.getDistance(a, b, gs.distance)
+}
+
+func (gs *GridSpace) GetNeighbours(id uuid.UUID, radius float64) []uuid.UUID {
+	return gs.index.neighbours(id, math.Floor(radius), gs.distance)
+}
+
+func (gs *GridSpace) GetRandomPosition(rng *rand.Rand) Position {
+	return Position{float64(rng.Intn(int(gs.index.width))), float64(rng.Intn(int(gs.index.height)))}
+}
+
+func (gs *GridSpace) Clone() Space {
+	clone := &GridSpace{}
+	gs.index.cloneInto(&clone.index)
+	return clone
+}
+
+// Plane with euclidean distances. Neighbourhood queries are fastest if the cell size is close to the partner search
+// radius.
+type ContinuousSpace struct {
+	index spaceIndex
+}
+
+func CreateContinuousSpace(width, height float64, isTorus bool, cellSize float64) *ContinuousSpace {
+	if cellSize <= 0 {
+		panic(fmt.Sprintf("Cell size has to be positive, was (%v)", cellSize))
+	}
+	cs := &ContinuousSpace{}
+	cs.index.createSpaceIndex(width, height, isTorus, cellSize)
+	return cs
+}
+
+func (cs *ContinuousSpace) distance(a, b Position) float64 {
+	return math.Hypot(cs.index.delta(a.X, b.X, cs.index.width), cs.index.delta(a.Y, b.Y, cs.index.height))
+}
+
+func (cs *ContinuousSpace) Place(id uuid.UUID, position Position) error {
+	return cs.index.place(id, position)
+}
+
+func (cs *ContinuousSpace) Remove(id uuid.UUID) {
+	cs.index.mutex.Lock()
+	cs.index.remove(id)
+	cs.index.mutex.Unlock()
+}
+
+func (cs *ContinuousSpace) GetPosition(id uuid.UUID) (Position, bool) {
+	return cs.index.getPosition(id)
+}
+
+func (cs *ContinuousSpace) GetDistance(a, b uuid.UUID) (float64, bool) {
+	return cs.index.getDistance(a, b, cs.distance)
+}
+
+func (cs *ContinuousSpace) GetNeighbours(id uuid.UUID, radius float64) []uuid.UUID {
+	return cs.index.neighbours(id, radius, cs.distance)
+}
+
+func (cs *ContinuousSpace) GetRandomPosition(rng *rand.Rand) Position {
+	return Position{rng.Float64() * cs.index.width, rng.Float64() * cs.index.height}
+}
+
+func (cs *ContinuousSpace) Clone() Space {
+	clone := &ContinuousSpace{}
+	cs.index.cloneInto(&clone.index)
+	return clone
+}
+
+// Scenario files
+
+type SpaceConfig struct {
+	Type                string  `json:"type" yaml:"type"` // SPACE_GRID or SPACE_CONTINUOUS
+	Width               float64 `json:"width" yaml:"width"`
+	Height              float64 `json:"height" yaml:"height"`
+	IsTorus             bool    `json:"isTorus,omitempty" yaml:"isTorus,omitempty"`
+	PartnerSearchRadius float64 `json:"partnerSearchRadius" yaml:"partnerSearchRadius"`
+	// Model agents spawned from the config are placed at random positions drawn from the seed
+	PlaceRandomly bool `json:"placeRandomly,omitempty" yaml:"placeRandomly,omitempty"`
+}
+
+func (sc *SpaceConfig) createSpace() (Space, error) {
+	if sc.Width <= 0 || sc.Height <= 0 {
+		return nil, fmt.Errorf("space dimensions have to be positive, were (%v, %v)", sc.Width, sc.Height)
+	}
+	if sc.PartnerSearchRadius < 0 {
+		return nil, fmt.Errorf("partner search radius cannot be negative, was (%v)", sc.PartnerSearchRadius)
+	}
+	switch sc.Type {
+	case SPACE_GRID:
+		return CreateGridSpace(int(sc.Width), int(sc.Height), sc.IsTorus), nil
+	case SPACE_CONTINUOUS:
+		cellSize := sc.PartnerSearchRadius
+		if cellSize == 0 {
+			cellSize = 1
+		}
+		return CreateContinuousSpace(sc.Width, sc.Height, sc.IsTorus, cellSize), nil
+	}
+	return nil, fmt.Errorf("unknown space type (%v)", sc.Type)
+}
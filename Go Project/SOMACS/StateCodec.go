@@ -0,0 +1,200 @@
+package SOMACS
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+)
+
+// The framework stores states, environment variables and message data as bytes, codecs translate them to typed
+// values. Empty data decodes to the zero value for every codec since agents start out with an empty state.
+type StateCodec[T any] interface {
+	Encode(T) ([]byte, error)
+	Decode([]byte) (T, error)
+}
+
+// Numeric states, predictors average and fit them (s. Predictor.go)
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~float32 | ~float64
+}
+
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(value T) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	if len(data) == 0 {
+		return value, nil
+	}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	if len(data) == 0 {
+		return value, nil
+	}
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// Fixed-width values only (sized numbers, bools and arrays or structs of them), little endian unless Order is set.
+// The most compact codec, a uint16 state takes two bytes.
+type BinaryCodec[T any] struct {
+	Order binary.ByteOrder
+}
+
+func (bc BinaryCodec[T]) byteOrder() binary.ByteOrder {
+	if bc.Order == nil {
+		return binary.LittleEndian
+	}
+	return bc.Order
+}
+
+func (bc BinaryCodec[T]) Encode(value T) ([]byte, error) {
+	return binary.Append(nil, bc.byteOrder(), value)
+}
+
+func (bc BinaryCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	if len(data) == 0 {
+		return value, nil
+	}
+	n, err := binary.Decode(data, bc.byteOrder(), &value)
+	if err != nil {
+		return value, err
+	}
+	if n != len(data) {
+		return value, fmt.Errorf("binary state has (%v) trailing bytes", len(data)-n)
+	}
+	return value, nil
+}
+
+func mustEncode[T any](codec StateCodec[T], value T) []byte {
+	data, err := codec.Encode(value)
+	if err != nil {
+		panic(fmt.Sprintf("Could not encode state (%v): %v", value, err))
+	}
+	return data
+}
+
+func mustDecode[T any](codec StateCodec[T], data []byte) T {
+	value, err := codec.Decode(data)
+	if err != nil {
+		panic(fmt.Sprintf("Could not decode state (%v): %v", data, err))
+	}
+	return value
+}
+
+// Typed helpers
+
+func GetStateAs[T any](ma *ModelAgent, codec StateCodec[T]) (T, error) {
+	return codec.Decode(ma.state)
+}
+
+// The update function cannot report errors, encoding errors panic
+func SetStateUpdateFuncTyped[T any](ma *ModelAgent, codec StateCodec[T], stateUpdateFunc func() T) {
+	ma.SetStateUpdateFunc(func() []byte { return mustEncode(codec, stateUpdateFunc()) })
+}
+
+func GetMessageDataAs[T any](msg Message, codec StateCodec[T]) (T, error) {
+	return codec.Decode(msg.Data)
+}
+
+func SetMessageData[T any](msg *Message, codec StateCodec[T], value T) error {
+	data, err := codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	return nil
+}
+
+// Works with both the Server and model agents
+func GetEnvironmentVariableAs[T any](environment interface {
+	GetEnvironmentVariable(string) ([]byte, bool)
+}, key string, codec StateCodec[T]) (T, bool, error) {
+	data, ok := environment.GetEnvironmentVariable(key)
+	if !ok {
+		var value T
+		return value, false, nil
+	}
+	value, err := codec.Decode(data)
+	return value, true, err
+}
+
+func SetEnvironmentVariableTyped[T any](serv *Server, key string, codec StateCodec[T], value T) error {
+	return SetVariableTyped(&serv.environment, key, codec, value)
+}
+
+func DecodeStates[T any](states map[uuid.UUID][]byte, codec StateCodec[T]) (map[uuid.UUID]T, error) {
+	decoded := make(map[uuid.UUID]T, len(states))
+	for id, state := range states {
+		value, err := codec.Decode(state)
+		if err != nil {
+			return nil, fmt.Errorf("decoding state of agent (%v): %w", id, err)
+		}
+		decoded[id] = value
+	}
+	return decoded, nil
+}
+
+func EncodeStates[T any](states map[uuid.UUID]T, codec StateCodec[T]) (map[uuid.UUID][]byte, error) {
+	encoded := make(map[uuid.UUID][]byte, len(states))
+	for id, value := range states {
+		data, err := codec.Encode(value)
+		if err != nil {
+			return nil, fmt.Errorf("encoding state of agent (%v): %w", id, err)
+		}
+		encoded[id] = data
+	}
+	return encoded, nil
+}
+
+// Wraps a typed predict function for MetaAgentDefinition, it receives the states of the directly subsumed model agents
+func TypedPredict[T any](codec StateCodec[T], predict func(*MessageStatistics, map[uuid.UUID]T) map[uuid.UUID]T) func(*MessageStatistics, *MetaState) map[uuid.UUID][]byte {
+	return func(messageStatistics *MessageStatistics, state *MetaState) map[uuid.UUID][]byte {
+		states := make(map[uuid.UUID]T, len(state.ModelStates))
+		for id, data := range state.ModelStates {
+			states[id] = mustDecode(codec, data)
+		}
+		predictions := predict(messageStatistics, states)
+		encoded := make(map[uuid.UUID][]byte, len(predictions))
+		for id, value := range predictions {
+			encoded[id] = mustEncode(codec, value)
+		}
+		return encoded
+	}
+}
+
+// Wraps a typed verify function for MetaAgentDefinition, current and base states include all recursively subsumed agents
+func TypedVerify[T any](codec StateCodec[T], verify func(messageStatistics *MessageStatistics, current, base map[uuid.UUID]T) bool) func(*MessageStatistics, *MetaState, map[uuid.UUID][]byte) bool {
+	return func(messageStatistics *MessageStatistics, state *MetaState, baseState map[uuid.UUID][]byte) bool {
+		current := make(map[uuid.UUID]T)
+		for id, data := range state.GetModelStatesRecursive() {
+			current[id] = mustDecode(codec, data)
+		}
+		base := make(map[uuid.UUID]T, len(baseState))
+		for id, data := range baseState {
+			base[id] = mustDecode(codec, data)
+		}
+		return verify(messageStatistics, current, base)
+	}
+}
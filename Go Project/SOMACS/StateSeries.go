@@ -0,0 +1,183 @@
+package SOMACS
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"math"
+	"slices"
+)
+
+// States of the observed model agents over the last iterations, so observers can check that the states of a group
+// settled before scheduling a meta agent for it. Iterations an agent sent no state update in are missing from its
+// series.
+
+type StateSample struct {
+	Iteration int // Starting at 1
+	State     []byte
+}
+
+// Appends the states of the iteration and drops samples older than the series length
+func (ss *StateStatistics) extendSeries(iteration int) {
+	if ss.seriesLength < 1 {
+		return
+	}
+	ss.mutex.Lock()
+	for id, state := range ss.states {
+		if len(state) > 0 {
+			ss.series[id] = append(ss.series[id], StateSample{iteration, state})
+		}
+	}
+	for id, samples := range ss.series {
+		samples = slices.DeleteFunc(samples, func(sample StateSample) bool { return sample.Iteration <= iteration-ss.seriesLength })
+		if len(samples) == 0 {
+			delete(ss.series, id)
+		} else {
+			ss.series[id] = samples
+		}
+	}
+	ss.mutex.Unlock()
+}
+
+func (ss *StateStatistics) copySeries(other *StateStatistics) {
+	ss.seriesLength = other.seriesLength
+	for id, samples := range other.series {
+		ss.series[id] = slices.Clone(samples)
+	}
+}
+
+// Values of a series together with the iterations they were recorded in
+type StateSeries struct {
+	Iterations []int
+	Values     []float64
+}
+
+// Exposed Functions
+
+// Number of iterations the series reach back, 0 disables them
+func (ss *StateStatistics) SetSeriesLength(iterations int) {
+	ss.seriesLength = max(iterations, 0)
+	if ss.seriesLength == 0 {
+		clear(ss.series)
+	}
+}
+
+func (ss *StateStatistics) GetSeriesLength() int {
+	return ss.seriesLength
+}
+
+// Oldest first
+func (ss *StateStatistics) GetStateSamples(agent uuid.UUID) []StateSample {
+	return ss.series[agent]
+}
+
+func GetStateSeries[T Number](statistics *StateStatistics, codec StateCodec[T], agent uuid.UUID) (StateSeries, error) {
+	samples := statistics.GetStateSamples(agent)
+	series := StateSeries{make([]int, len(samples)), make([]float64, len(samples))}
+	for i, sample := range samples {
+		value, err := codec.Decode(sample.State)
+		if err != nil {
+			return StateSeries{}, fmt.Errorf("state of agent (%v) in iteration (%v) could not be decoded: %v", agent, sample.Iteration, err)
+		}
+		series.Iterations[i] = sample.Iteration
+		series.Values[i] = float64(value)
+	}
+	return series, nil
+}
+
+// All agents have at least minSamples samples and a stationary series (s. StateSeries.IsStationary)
+func AreStatesStationary[T Number](statistics *StateStatistics, codec StateCodec[T], agents []uuid.UUID, minSamples int, tolerance float64) bool {
+	for _, id := range agents {
+		series, err := GetStateSeries(statistics, codec, id)
+		if err != nil || series.Len() < minSamples || !series.IsStationary(tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ss StateSeries) Len() int {
+	return len(ss.Values)
+}
+
+// Change per iteration between consecutive samples, gaps are divided out
+func (ss StateSeries) GetRatesOfChange() []float64 {
+	rates := make([]float64, 0, max(ss.Len()-1, 0))
+	for i := 1; i < ss.Len(); i++ {
+		rates = append(rates, (ss.Values[i]-ss.Values[i-1])/float64(ss.Iterations[i]-ss.Iterations[i-1]))
+	}
+	return rates
+}
+
+// Change per iteration from the first to the last sample, zero for less than two samples
+func (ss StateSeries) GetMeanRateOfChange() float64 {
+	if ss.Len() < 2 {
+		return 0
+	}
+	return (ss.Values[ss.Len()-1] - ss.Values[0]) / float64(ss.Iterations[ss.Len()-1]-ss.Iterations[0])
+}
+
+func (ss StateSeries) GetMean() float64 {
+	return getMean(ss.Values)
+}
+
+// Population variance, zero for an empty series
+func (ss StateSeries) GetVariance() float64 {
+	return getVariance(ss.Values)
+}
+
+// Autocorrelation of the values lag samples apart, zero if the series is constant or not longer than the lag
+func (ss StateSeries) GetAutocorrelation(lag int) float64 {
+	if lag < 0 || lag >= ss.Len() {
+		return 0
+	}
+	mean := ss.GetMean()
+	numerator, denominator := 0.0, 0.0
+	for i, value := range ss.Values {
+		denominator += (value - mean) * (value - mean)
+		if i >= lag {
+			numerator += (value - mean) * (ss.Values[i-lag] - mean)
+		}
+	}
+	if denominator == 0 {
+		return 0
+	}
+	return numerator / denominator
+}
+
+// Compares the halves of the series, stationary if neither their means nor their standard deviations differ by more
+// than the tolerance. Needs at least four samples.
+func (ss StateSeries) IsStationary(tolerance float64) bool {
+	if ss.Len() < 4 {
+		return false
+	}
+	first, second := ss.Values[:ss.Len()/2], ss.Values[ss.Len()/2:]
+	if math.Abs(getMean(first)-getMean(second)) > tolerance {
+		return false
+	}
+	return math.Abs(math.Sqrt(getVariance(first))-math.Sqrt(getVariance(second))) <= tolerance
+}
+
+// Helpers
+
+func getMean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	return sum / float64(len(values))
+}
+
+func getVariance(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	mean := getMean(values)
+	sum := 0.0
+	for _, value := range values {
+		sum += (value - mean) * (value - mean)
+	}
+	return sum / float64(len(values))
+}
@@ -10,12 +10,17 @@ type StateStatistics struct {
 	metaStates    map[uuid.UUID]*MetaState
 	metaDissolved map[uuid.UUID]bool
 	mutex         sync.Mutex
+
+	// Kept across iterations (s. StateSeries.go)
+	seriesLength int
+	series       map[uuid.UUID][]StateSample
 }
 
 func (ss *StateStatistics) createStateStatistics() {
 	ss.states = make(map[uuid.UUID][]byte)
 	ss.metaStates = make(map[uuid.UUID]*MetaState)
 	ss.metaDissolved = make(map[uuid.UUID]bool)
+	ss.series = make(map[uuid.UUID][]StateSample)
 }
 
 func (ss *StateStatistics) recordState(msg Message) {
@@ -0,0 +1,352 @@
+package SOMACS
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"math/rand"
+	"slices"
+	"sync"
+)
+
+const TOPOLOGY_RING_LATTICE = "ringLattice"
+const TOPOLOGY_GRID_LATTICE = "gridLattice"
+const TOPOLOGY_SMALL_WORLD = "smallWorld"
+const TOPOLOGY_SCALE_FREE = "scaleFree"
+
+// Undirected graph over model agents, partner search only contacts graph neighbours if the server has a topology.
+// Neighbour lists are kept sorted so partner search visits them in the same order every run.
+type Topology struct {
+	adjacency map[uuid.UUID][]uuid.UUID
+	mutex     sync.RWMutex
+}
+
+func CreateTopology() *Topology {
+	return &Topology{adjacency: make(map[uuid.UUID][]uuid.UUID)}
+}
+
+// Edges are added in both directions, so the adjacency list does not have to be symmetric
+func CreateTopologyFromAdjacency(adjacency map[uuid.UUID][]uuid.UUID) (*Topology, error) {
+	tp := CreateTopology()
+	for _, id := range sortedIDs(adjacency) {
+		tp.AddNode(id)
+		for _, neighbour := range adjacency[id] {
+			if err := tp.AddEdge(id, neighbour); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tp, nil
+}
+
+// Has to be called with the lock held
+func (tp *Topology) insert(a, b uuid.UUID) {
+	i, found := slices.BinarySearchFunc(tp.adjacency[a], b, compareIDs)
+	if !found {
+		tp.adjacency[a] = slices.Insert(tp.adjacency[a], i, b)
+	}
+}
+
+// Has to be called with the lock held
+func (tp *Topology) delete(a, b uuid.UUID) {
+	i, found := slices.BinarySearchFunc(tp.adjacency[a], b, compareIDs)
+	if found {
+		tp.adjacency[a] = slices.Delete(tp.adjacency[a], i, i+1)
+	}
+}
+
+// Exposed Functions
+
+func (tp *Topology) AddNode(id uuid.UUID) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	if _, ok := tp.adjacency[id]; !ok {
+		tp.adjacency[id] = make([]uuid.UUID, 0)
+	}
+}
+
+func (tp *Topology) RemoveNode(id uuid.UUID) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	for _, neighbour := range tp.adjacency[id] {
+		tp.delete(neighbour, id)
+	}
+	delete(tp.adjacency, id)
+}
+
+func (tp *Topology) AddEdge(a, b uuid.UUID) error {
+	if a == b {
+		return fmt.Errorf("agent (%v) cannot be its own neighbour", a)
+	}
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	tp.insert(a, b)
+	tp.insert(b, a)
+	return nil
+}
+
+func (tp *Topology) RemoveEdge(a, b uuid.UUID) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	tp.delete(a, b)
+	tp.delete(b, a)
+}
+
+func (tp *Topology) HasEdge(a, b uuid.UUID) bool {
+	tp.mutex.RLock()
+	defer tp.mutex.RUnlock()
+	_, found := slices.BinarySearchFunc(tp.adjacency[a], b, compareIDs)
+	return found
+}
+
+// Sorted by id
+func (tp *Topology) GetNeighbours(id uuid.UUID) []uuid.UUID {
+	tp.mutex.RLock()
+	defer tp.mutex.RUnlock()
+	return slices.Clone(tp.adjacency[id])
+}
+
+func (tp *Topology) GetDegree(id uuid.UUID) int {
+	tp.mutex.RLock()
+	defer tp.mutex.RUnlock()
+	return len(tp.adjacency[id])
+}
+
+func (tp *Topology) GetNodes() []uuid.UUID {
+	tp.mutex.RLock()
+	defer tp.mutex.RUnlock()
+	return sortedIDs(tp.adjacency)
+}
+
+func (tp *Topology) GetEdgeCount() int {
+	tp.mutex.RLock()
+	defer tp.mutex.RUnlock()
+	count := 0
+	for _, neighbours := range tp.adjacency {
+		count += len(neighbours)
+	}
+	return count / 2
+}
+
+// Copy of the graph between the given nodes only
+func (tp *Topology) Subgraph(ids []uuid.UUID) *Topology {
+	included := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		included[id] = true
+	}
+	tp.mutex.RLock()
+	defer tp.mutex.RUnlock()
+	subgraph := CreateTopology()
+	for id, neighbours := range tp.adjacency {
+		if !included[id] {
+			continue
+		}
+		subgraph.adjacency[id] = slices.DeleteFunc(slices.Clone(neighbours), func(neighbour uuid.UUID) bool { return !included[neighbour] })
+	}
+	return subgraph
+}
+
+func (tp *Topology) GetAdjacency() map[uuid.UUID][]uuid.UUID {
+	tp.mutex.RLock()
+	defer tp.mutex.RUnlock()
+	adjacency := make(map[uuid.UUID][]uuid.UUID, len(tp.adjacency))
+	for id, neighbours := range tp.adjacency {
+		adjacency[id] = slices.Clone(neighbours)
+	}
+	return adjacency
+}
+
+// Generators, agents are connected in the order of ids
+
+// Ring where every agent is connected to the degree/2 closest agents on either side
+func CreateRingLatticeTopology(ids []uuid.UUID, degree int) (*Topology, error) {
+	if degree%2 != 0 || degree < 0 || (len(ids) > 0 && degree >= len(ids)) {
+		return nil, fmt.Errorf("ring lattice degree has to be even and less than the number of agents (%v), was (%v)", len(ids), degree)
+	}
+	tp := CreateTopology()
+	for i, id := range ids {
+		tp.AddNode(id)
+		for j := 1; j <= degree/2; j++ {
+			tp.AddEdge(id, ids[(i+j)%len(ids)])
+		}
+	}
+	return tp, nil
+}
+
+// Rows of the given width, every agent is connected to the agents above, below, left and right of it
+func CreateGridLatticeTopology(ids []uuid.UUID, width int, isTorus bool) (*Topology, error) {
+	if width < 1 {
+		return nil, fmt.Errorf("grid lattice width has to be positive, was (%v)", width)
+	}
+	if isTorus && len(ids)%width != 0 {
+		return nil, fmt.Errorf("toroidal grid lattice needs full rows, (%v) agents do not fit width (%v)", len(ids), width)
+	}
+	rows := (len(ids) + width - 1) / width
+	tp := CreateTopology()
+	for i, id := range ids {
+		tp.AddNode(id)
+		x, y := i%width, i/width
+		right, down := i+1, i+width
+		if x+1 == width {
+			right = -1
+			if isTorus && width > 2 {
+				right = y * width
+			}
+		}
+		if y+1 == rows {
+			down = -1
+			if isTorus && rows > 2 {
+				down = x
+			}
+		}
+		if right >= 0 && right < len(ids) {
+			tp.AddEdge(id, ids[right])
+		}
+		if down >= 0 && down < len(ids) {
+			tp.AddEdge(id, ids[down])
+		}
+	}
+	return tp, nil
+}
+
+// Watts-Strogatz: a ring lattice where every edge is rewired to a random agent with the given probability
+func CreateSmallWorldTopology(ids []uuid.UUID, degree int, rewiringProbability float64, rng *rand.Rand) (*Topology, error) {
+	if rewiringProbability < 0 || rewiringProbability > 1 {
+		return nil, fmt.Errorf("rewiring probability has to be within [0, 1], was (%v)", rewiringProbability)
+	}
+	tp, err := CreateRingLatticeTopology(ids, degree)
+	if err != nil {
+		return nil, err
+	}
+	for j := 1; j <= degree/2; j++ {
+		for i, id := range ids {
+			if rng.Float64() >= rewiringProbability {
+				continue
+			}
+			// Edges may already be gone through rewiring of the other end, agents connected to everyone keep their edges
+			if !tp.HasEdge(id, ids[(i+j)%len(ids)]) || tp.GetDegree(id) >= len(ids)-1 {
+				continue
+			}
+			target := ids[rng.Intn(len(ids))]
+			for target == id || tp.HasEdge(id, target) {
+				target = ids[rng.Intn(len(ids))]
+			}
+			tp.RemoveEdge(id, ids[(i+j)%len(ids)])
+			tp.AddEdge(id, target)
+		}
+	}
+	return tp, nil
+}
+
+// Barabasi-Albert: starts with a clique of attachments+1 agents, every further agent connects to attachments distinct
+// agents chosen proportionally to their degree
+func CreateScaleFreeTopology(ids []uuid.UUID, attachments int, rng *rand.Rand) (*Topology, error) {
+	if attachments < 1 || attachments >= len(ids) {
+		return nil, fmt.Errorf("scale free attachments have to be at least 1 and less than the number of agents (%v), was (%v)", len(ids), attachments)
+	}
+	tp := CreateTopology()
+	// Every agent appears once per edge end, drawing from it is drawing proportionally to degree
+	endpoints := make([]uuid.UUID, 0, 2*attachments*len(ids))
+	for i := 0; i <= attachments; i++ {
+		tp.AddNode(ids[i])
+		for j := 0; j < i; j++ {
+			tp.AddEdge(ids[i], ids[j])
+			endpoints = append(endpoints, ids[i], ids[j])
+		}
+	}
+	for _, id := range ids[attachments+1:] {
+		tp.AddNode(id)
+		targets := make([]uuid.UUID, 0, attachments)
+		for len(targets) < attachments {
+			target := endpoints[rng.Intn(len(endpoints))]
+			if !slices.Contains(targets, target) {
+				targets = append(targets, target)
+			}
+		}
+		for _, target := range targets {
+			tp.AddEdge(id, target)
+			endpoints = append(endpoints, id, target)
+		}
+	}
+	return tp, nil
+}
+
+// Topology generator registry, used by scenario files
+
+type TopologyConfig struct {
+	Type                string  `json:"type" yaml:"type"`
+	Degree              int     `json:"degree,omitempty" yaml:"degree,omitempty"`                           // Ring lattice and small world
+	Width               int     `json:"width,omitempty" yaml:"width,omitempty"`                             // Grid lattice
+	IsTorus             bool    `json:"isTorus,omitempty" yaml:"isTorus,omitempty"`                         // Grid lattice
+	RewiringProbability float64 `json:"rewiringProbability,omitempty" yaml:"rewiringProbability,omitempty"` // Small world
+	Attachments         int     `json:"attachments,omitempty" yaml:"attachments,omitempty"`                 // Scale free
+}
+
+var topologyMutex sync.RWMutex
+var topologyGenerators = map[string]func([]uuid.UUID, *TopologyConfig, *rand.Rand) (*Topology, error){
+	TOPOLOGY_RING_LATTICE: func(ids []uuid.UUID, config *TopologyConfig, _ *rand.Rand) (*Topology, error) {
+		return CreateRingLatticeTopology(ids, config.Degree)
+	},
+	TOPOLOGY_GRID_LATTICE: func(ids []uuid.UUID, config *TopologyConfig, _ *rand.Rand) (*Topology, error) {
+		return CreateGridLatticeTopology(ids, config.Width, config.IsTorus)
+	},
+	TOPOLOGY_SMALL_WORLD: func(ids []uuid.UUID, config *TopologyConfig, rng *rand.Rand) (*Topology, error) {
+		return CreateSmallWorldTopology(ids, config.Degree, config.RewiringProbability, rng)
+	},
+	TOPOLOGY_SCALE_FREE: func(ids []uuid.UUID, config *TopologyConfig, rng *rand.Rand) (*Topology, error) {
+		return CreateScaleFreeTopology(ids, config.Attachments, rng)
+	},
+}
+
+func RegisterTopologyGenerator(name string, generator func([]uuid.UUID, *TopologyConfig, *rand.Rand) (*Topology, error)) {
+	topologyMutex.Lock()
+	topologyGenerators[name] = generator
+	topologyMutex.Unlock()
+}
+
+func (tc *TopologyConfig) createTopology(ids []uuid.UUID, rng *rand.Rand) (*Topology, error) {
+	topologyMutex.RLock()
+	generator, ok := topologyGenerators[tc.Type]
+	topologyMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no topology generator registered for type (%v)", tc.Type)
+	}
+	return generator(ids, tc, rng)
+}
+
+// Partner search scope, combines space and topology. With both set agents have to be graph neighbours within the
+// partner search radius.
+
+type partnerScope struct {
+	space    Space
+	radius   float64
+	topology *Topology
+}
+
+func (ps *partnerScope) isRestricted() bool {
+	return ps.space != nil || ps.topology != nil
+}
+
+// Sorted by id
+func (ps *partnerScope) neighbours(id uuid.UUID) []uuid.UUID {
+	if ps.topology == nil {
+		return ps.space.GetNeighbours(id, ps.radius)
+	}
+	neighbours := ps.topology.GetNeighbours(id)
+	if ps.space != nil {
+		neighbours = slices.DeleteFunc(neighbours, func(neighbour uuid.UUID) bool { return !ps.isWithinRadius(id, neighbour) })
+	}
+	return neighbours
+}
+
+func (ps *partnerScope) isWithinRadius(a, b uuid.UUID) bool {
+	distance, ok := ps.space.GetDistance(a, b)
+	return ok && distance <= ps.radius
+}
+
+// Without restrictions every pair of model agents are candidates
+func (ps *partnerScope) allows(a, b uuid.UUID) bool {
+	if ps.topology != nil && !ps.topology.HasEdge(a, b) {
+		return false
+	}
+	return ps.space == nil || ps.isWithinRadius(a, b)
+}
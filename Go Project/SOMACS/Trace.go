@@ -0,0 +1,155 @@
+package SOMACS
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"os"
+	"sync"
+)
+
+// One line of the trace, written at the end of every iteration. States and environment are the ones saved to memory.
+type TraceRecord struct {
+	Iteration            int // Completed iterations including this one
+	ModelStates          map[uuid.UUID][]byte
+	EnvironmentVariables map[string][]byte
+	MetaAgents           []MetaAgentSnapshot // All meta agents alive after cleanup, in creation order
+	MetaAgentsCreated    []uuid.UUID
+	MetaAgentsDissolved  []uuid.UUID
+	DissolveReasons      map[uuid.UUID]DissolveReason `json:",omitempty"` // Meta agents deleted by a rollback have none
+	MetaHierarchy        []MetaHierarchySnapshot
+	MessageCounts        map[string]map[int]int // map[phase][message type]count, deliveries to model and meta agents
+	Messages             []TracedMessage        `json:",omitempty"`
+	ShadowReports        []ShadowReport         `json:",omitempty"` // Only in shadow mode
+}
+
+type TracedMessage struct {
+	Phase       string
+	Sender      uuid.UUID
+	Recipient   uuid.UUID
+	MessageType int
+	Data        []byte
+}
+
+type TraceRecorder struct {
+	encoder        *json.Encoder
+	writer         io.Writer
+	recordMessages bool
+	err            error
+
+	knownMetaAgents map[uuid.UUID]bool
+	dissolveReasons map[uuid.UUID]DissolveReason
+	messageCounts   map[string]map[int]int
+	messages        []TracedMessage
+	mutex           sync.Mutex
+}
+
+func CreateTraceRecorder(w io.Writer) *TraceRecorder {
+	tr := &TraceRecorder{encoder: json.NewEncoder(w), writer: w}
+	tr.knownMetaAgents = make(map[uuid.UUID]bool)
+	tr.dissolveReasons = make(map[uuid.UUID]DissolveReason)
+	tr.messageCounts = make(map[string]map[int]int)
+	tr.messages = make([]TracedMessage, 0)
+	return tr
+}
+
+func CreateTraceRecorderFile(path string) (*TraceRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return CreateTraceRecorder(file), nil
+}
+
+// Called concurrently for asynchronous messages
+func (tr *TraceRecorder) recordDelivery(phase string, msg Message, recipient uuid.UUID) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	counts, ok := tr.messageCounts[phase]
+	if !ok {
+		counts = make(map[int]int)
+		tr.messageCounts[phase] = counts
+	}
+	counts[msg.MessageType]++
+	if tr.recordMessages {
+		tr.messages = append(tr.messages, TracedMessage{phase, msg.GetSender(), recipient, msg.MessageType, msg.Data})
+	}
+}
+
+func (tr *TraceRecorder) recordDissolveReason(id uuid.UUID, reason DissolveReason) {
+	tr.mutex.Lock()
+	tr.dissolveReasons[id] = reason
+	tr.mutex.Unlock()
+}
+
+func (tr *TraceRecorder) recordIteration(serv *Server) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	record := TraceRecord{
+		Iteration:            serv.iteration + 1,
+		ModelStates:          serv.modelStates(),
+		EnvironmentVariables: serv.environment.GetAll(),
+		MetaAgents:           serv.snapshotMetaAgents(),
+		MetaAgentsCreated:    make([]uuid.UUID, 0),
+		MetaAgentsDissolved:  make([]uuid.UUID, 0),
+		DissolveReasons:      tr.dissolveReasons,
+		MetaHierarchy:        serv.metaHierarchy.snapshot(),
+		MessageCounts:        tr.messageCounts,
+		Messages:             tr.messages,
+		ShadowReports:        serv.shadowReports,
+	}
+	for _, snapshot := range record.MetaAgents {
+		if !tr.knownMetaAgents[snapshot.Id] {
+			tr.knownMetaAgents[snapshot.Id] = true
+			record.MetaAgentsCreated = append(record.MetaAgentsCreated, snapshot.Id)
+		}
+	}
+	for _, id := range sortedIDs(tr.knownMetaAgents) {
+		if _, ok := serv.metaAgentMap[id]; !ok {
+			delete(tr.knownMetaAgents, id)
+			record.MetaAgentsDissolved = append(record.MetaAgentsDissolved, id)
+		}
+	}
+	tr.messageCounts = make(map[string]map[int]int)
+	tr.messages = make([]TracedMessage, 0)
+	tr.dissolveReasons = make(map[uuid.UUID]DissolveReason)
+
+	if tr.err != nil {
+		return
+	}
+	if err := tr.encoder.Encode(record); err != nil {
+		tr.err = fmt.Errorf("writing trace record for iteration (%v): %w", record.Iteration, err)
+		serv.logger.Error("trace recording stopped", "iteration", record.Iteration, "error", err)
+	}
+}
+
+// Exposed Functions
+
+// Messages are not part of the trace by default as they make up most of its size
+func (tr *TraceRecorder) SetRecordMessages(value bool) {
+	tr.mutex.Lock()
+	tr.recordMessages = value
+	tr.mutex.Unlock()
+}
+
+// The first write error, the recorder stops writing once one occurred
+func (tr *TraceRecorder) Err() error {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	return tr.err
+}
+
+// Closes the underlying writer if it can be closed
+func (tr *TraceRecorder) Close() error {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	closer, ok := tr.writer.(io.Closer)
+	if !ok {
+		return tr.err
+	}
+	if err := closer.Close(); err != nil {
+		return err
+	}
+	return tr.err
+}
@@ -0,0 +1,330 @@
+package SOMACS
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"math"
+	"strings"
+	"sync"
+)
+
+// Policies decide whether a meta agent still represents its members. Check returns a reason describing the outcome
+// either way, the reason of a failing policy is logged when VerifyAndDissolve dissolves the meta agent.
+type VerificationPolicy interface {
+	Check(context *VerificationContext) (bool, string)
+}
+
+type VerificationContext struct {
+	MetaAgent         *MetaAgent
+	MessageStatistics *MessageStatistics
+	State             *MetaState
+	BaseState         map[uuid.UUID][]byte // States of all recursively subsumed agents when the meta agent was created
+	Age               int                  // Iterations since the meta agent was created
+	Environment       *Environment
+}
+
+// Policies that can name the model agents failing them, meta agents that eject or split members need one
+// (s. PartialDissolution.go)
+type MemberVerificationPolicy interface {
+	VerificationPolicy
+	CheckMembers(context *VerificationContext) VerificationResult
+}
+
+type VerificationResult struct {
+	Passed         bool
+	Reason         string
+	FailingMembers []uuid.UUID // Model agents causing the failure, empty if it concerns the meta agent as a whole
+}
+
+func checkMembers(policy VerificationPolicy, context *VerificationContext) VerificationResult {
+	if memberPolicy, ok := policy.(MemberVerificationPolicy); ok {
+		return memberPolicy.CheckMembers(context)
+	}
+	ok, reason := policy.Check(context)
+	return VerificationResult{ok, reason, nil}
+}
+
+// Policies keeping state per meta agent drop it once the meta agent is gone, whatever it dissolved for
+type statefulPolicy interface {
+	forget(metaAgent uuid.UUID)
+}
+
+func forgetMetaAgent(policy VerificationPolicy, metaAgent uuid.UUID) {
+	if sp, ok := policy.(statefulPolicy); ok {
+		sp.forget(metaAgent)
+	}
+}
+
+// Adapts a plain function
+type VerificationPolicyFunc func(context *VerificationContext) (bool, string)
+
+func (vpf VerificationPolicyFunc) Check(context *VerificationContext) (bool, string) {
+	return vpf(context)
+}
+
+// Undecodable states, such as the missing base state of a member spawned later, fail the policy instead of panicking
+func decodeMemberStates[T Number](codec StateCodec[T], id uuid.UUID, state, base []byte) (float64, float64, error) {
+	currentValue, err := codec.Decode(state)
+	if err != nil {
+		return 0, 0, fmt.Errorf("state of agent (%v) could not be decoded: %v", id, err)
+	}
+	baseValue, err := codec.Decode(base)
+	if err != nil {
+		return 0, 0, fmt.Errorf("base state of agent (%v) could not be decoded: %v", id, err)
+	}
+	return float64(currentValue), float64(baseValue), nil
+}
+
+// Error policies
+
+type errorPolicy[T Number] struct {
+	codec    StateCodec[T]
+	bound    float64
+	name     string
+	getError func(current, base float64) float64
+}
+
+func (ep errorPolicy[T]) Check(context *VerificationContext) (bool, string) {
+	result := ep.CheckMembers(context)
+	return result.Passed, result.Reason
+}
+
+func (ep errorPolicy[T]) CheckMembers(context *VerificationContext) VerificationResult {
+	current := context.State.GetModelStatesRecursive()
+	worstAgent, worstError := uuid.Nil, 0.0
+	failing := make([]uuid.UUID, 0)
+	for _, id := range sortedIDs(context.BaseState) {
+		state, ok := current[id]
+		if !ok {
+			continue
+		}
+		currentValue, baseValue, decodeErr := decodeMemberStates(ep.codec, id, state, context.BaseState[id])
+		if decodeErr != nil {
+			return VerificationResult{false, decodeErr.Error(), []uuid.UUID{id}}
+		}
+		err := ep.getError(currentValue, baseValue)
+		if err > ep.bound {
+			failing = append(failing, id)
+		}
+		if err > worstError {
+			worstAgent, worstError = id, err
+		}
+	}
+	if len(failing) > 0 {
+		reason := fmt.Sprintf("%v error (%.3g) of agent (%v) exceeds (%.3g) for (%v) agents", ep.name, worstError, worstAgent, ep.bound, len(failing))
+		return VerificationResult{false, reason, failing}
+	}
+	return VerificationResult{true, fmt.Sprintf("%v errors within (%.3g)", ep.name, ep.bound), nil}
+}
+
+// Fails if any member state deviates from its base state by more than the tolerance relative to the base state,
+// base states of zero are compared absolutely
+func CreateRelativeErrorPolicy[T Number](codec StateCodec[T], tolerance float64) VerificationPolicy {
+	return errorPolicy[T]{codec, tolerance, "relative", func(current, base float64) float64 {
+		return math.Abs(current-base) / math.Max(math.Abs(base), 1)
+	}}
+}
+
+func CreateAbsoluteErrorPolicy[T Number](codec StateCodec[T], bound float64) VerificationPolicy {
+	return errorPolicy[T]{codec, bound, "absolute", func(current, base float64) float64 {
+		return math.Abs(current - base)
+	}}
+}
+
+// Drift detection
+
+type driftPolicy[T Number] struct {
+	codec     StateCodec[T]
+	threshold float64
+	window    int
+	history   map[uuid.UUID][]float64
+	mutex     sync.Mutex
+}
+
+// Fails if the mean signed deviation of the members from their base states, averaged over the last window checks,
+// exceeds the threshold. Unlike the error policies single outliers pass while a steady shift does not.
+func CreateDriftPolicy[T Number](codec StateCodec[T], threshold float64, window int) VerificationPolicy {
+	if window < 1 {
+		panic(fmt.Sprintf("Drift window has to be positive, was (%v)", window))
+	}
+	return &driftPolicy[T]{codec: codec, threshold: threshold, window: window, history: make(map[uuid.UUID][]float64)}
+}
+
+func (dp *driftPolicy[T]) Check(context *VerificationContext) (bool, string) {
+	current := context.State.GetModelStatesRecursive()
+	deviation, count := 0.0, 0
+	for _, id := range sortedIDs(context.BaseState) {
+		state, ok := current[id]
+		if !ok {
+			continue
+		}
+		currentValue, baseValue, err := decodeMemberStates(dp.codec, id, state, context.BaseState[id])
+		if err != nil {
+			return false, err.Error()
+		}
+		deviation += currentValue - baseValue
+		count++
+	}
+	if count > 0 {
+		deviation /= float64(count)
+	}
+
+	id := context.MetaAgent.GetID()
+	dp.mutex.Lock()
+	history := append(dp.history[id], deviation)
+	if len(history) > dp.window {
+		history = history[1:]
+	}
+	dp.history[id] = history
+	drift := 0.0
+	for _, value := range history {
+		drift += value
+	}
+	drift /= float64(len(history))
+	if math.Abs(drift) > dp.threshold {
+		delete(dp.history, id)
+		dp.mutex.Unlock()
+		return false, fmt.Sprintf("drift (%.3g) over (%v) iterations exceeds (%.3g)", drift, len(history), dp.threshold)
+	}
+	dp.mutex.Unlock()
+	return true, fmt.Sprintf("drift (%.3g) within (%.3g)", drift, dp.threshold)
+}
+
+func (dp *driftPolicy[T]) forget(metaAgent uuid.UUID) {
+	dp.mutex.Lock()
+	delete(dp.history, metaAgent)
+	dp.mutex.Unlock()
+}
+
+// Lifetime and environment
+
+// Fails once the meta agent has existed for the given number of iterations
+func CreateMaxLifetimePolicy(iterations int) VerificationPolicy {
+	return VerificationPolicyFunc(func(context *VerificationContext) (bool, string) {
+		if context.Age >= iterations {
+			return false, fmt.Sprintf("age (%v) reached maximum lifetime (%v)", context.Age, iterations)
+		}
+		return true, fmt.Sprintf("age (%v) below maximum lifetime (%v)", context.Age, iterations)
+	})
+}
+
+// Holds while the condition accepts the environment variable, missing variables decode to the zero value
+func CreateEnvironmentGuardPolicy[T any](key string, codec StateCodec[T], condition func(T) bool) VerificationPolicy {
+	return VerificationPolicyFunc(func(context *VerificationContext) (bool, string) {
+		value, _, err := GetVariableAs(context.Environment, key, codec)
+		if err != nil {
+			return false, fmt.Sprintf("environment variable (%v) could not be decoded: %v", key, err)
+		}
+		if !condition(value) {
+			return false, fmt.Sprintf("environment variable (%v) with value (%v) violates guard", key, value)
+		}
+		return true, fmt.Sprintf("environment variable (%v) with value (%v) satisfies guard", key, value)
+	})
+}
+
+// Combinators, every policy is checked so stateful policies stay up to date
+
+type andPolicy []VerificationPolicy
+type orPolicy []VerificationPolicy
+
+func checkPolicies(policies []VerificationPolicy, context *VerificationContext) ([]VerificationResult, []VerificationResult) {
+	passed := make([]VerificationResult, 0, len(policies))
+	failed := make([]VerificationResult, 0, len(policies))
+	for _, policy := range policies {
+		result := checkMembers(policy, context)
+		if result.Passed {
+			passed = append(passed, result)
+		} else {
+			failed = append(failed, result)
+		}
+	}
+	return passed, failed
+}
+
+func joinReasons(results []VerificationResult) string {
+	reasons := make([]string, len(results))
+	for i, result := range results {
+		reasons[i] = result.Reason
+	}
+	return strings.Join(reasons, " and ")
+}
+
+func CreateAndPolicy(policies ...VerificationPolicy) VerificationPolicy {
+	return andPolicy(policies)
+}
+
+func (ap andPolicy) Check(context *VerificationContext) (bool, string) {
+	result := ap.CheckMembers(context)
+	return result.Passed, result.Reason
+}
+
+// Members failing any policy fail, unless a policy failed for the meta agent as a whole
+func (ap andPolicy) CheckMembers(context *VerificationContext) VerificationResult {
+	passed, failed := checkPolicies(ap, context)
+	if len(failed) == 0 {
+		return VerificationResult{true, joinReasons(passed), nil}
+	}
+	failing := make(map[uuid.UUID]bool)
+	for _, result := range failed {
+		if len(result.FailingMembers) == 0 {
+			return VerificationResult{false, joinReasons(failed), nil}
+		}
+		for _, id := range result.FailingMembers {
+			failing[id] = true
+		}
+	}
+	return VerificationResult{false, joinReasons(failed), sortedIDs(failing)}
+}
+
+func (ap andPolicy) forget(metaAgent uuid.UUID) {
+	for _, policy := range ap {
+		forgetMetaAgent(policy, metaAgent)
+	}
+}
+
+func CreateOrPolicy(policies ...VerificationPolicy) VerificationPolicy {
+	return orPolicy(policies)
+}
+
+func (op orPolicy) Check(context *VerificationContext) (bool, string) {
+	result := op.CheckMembers(context)
+	return result.Passed, result.Reason
+}
+
+// Without its failing members the policy failed by the fewest members would hold, and with it the combination
+func (op orPolicy) CheckMembers(context *VerificationContext) VerificationResult {
+	passed, failed := checkPolicies(op, context)
+	if len(passed) > 0 {
+		return VerificationResult{true, joinReasons(passed), nil}
+	}
+	var failing []uuid.UUID
+	for _, result := range failed {
+		if len(result.FailingMembers) > 0 && (failing == nil || len(result.FailingMembers) < len(failing)) {
+			failing = result.FailingMembers
+		}
+	}
+	return VerificationResult{false, joinReasons(failed), failing}
+}
+
+func (op orPolicy) forget(metaAgent uuid.UUID) {
+	for _, policy := range op {
+		forgetMetaAgent(policy, metaAgent)
+	}
+}
+
+type notPolicy struct {
+	policy VerificationPolicy
+}
+
+func CreateNotPolicy(policy VerificationPolicy) VerificationPolicy {
+	return notPolicy{policy}
+}
+
+func (np notPolicy) Check(context *VerificationContext) (bool, string) {
+	ok, reason := np.policy.Check(context)
+	return !ok, "not (" + reason + ")"
+}
+
+func (np notPolicy) forget(metaAgent uuid.UUID) {
+	forgetMetaAgent(np.policy, metaAgent)
+}
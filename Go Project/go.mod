@@ -3,6 +3,7 @@ module GRL1
 go 1.23.2
 
 require (
-	github.com/MattSScott/basePlatformSOMAS/v2 v2.1.0 // indirect
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/MattSScott/basePlatformSOMAS/v2 v2.1.0
+	github.com/google/uuid v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )